@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveAdmin exposes the runtime filter rules on their own listener, apart
+// from the metrics port:
+//
+//	GET    /admin/filters       list rules
+//	POST   /admin/filters       add a rule (JSON filterRule)
+//	DELETE /admin/filters/<id>  remove a rule
+//
+// When token is set, requests must carry it as a bearer token; without one
+// the API may only listen on a loopback address.
+func serveAdmin(address string, rules *ruleFilter, token string) error {
+	if token == "" && !isLoopback(address) {
+		return fmt.Errorf("--admin-token is required to serve the admin API on %s", address)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/filters", adminAuth(token, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, rules.list())
+		case "POST":
+			var rule filterRule
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				http.Error(w, "invalid rule: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			rule, err := rules.add(rule)
+			if err != nil {
+				adminError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, rule)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/admin/filters/", adminAuth(token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		found, err := rules.remove(strings.TrimPrefix(r.URL.Path, "/admin/filters/"))
+		if err != nil {
+			adminError(w, err)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	log.Printf("Starting admin server: %s", address)
+	go func() {
+		log.Fatal(http.ListenAndServe(address, mux))
+	}()
+	return nil
+}
+
+// isLoopback reports whether a listen address only accepts local
+// connections. An empty host listens on every interface.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminError maps a rule edit error to a status: the client's fault for a
+// rejected rule, the server's for a failure to load or persist the rules.
+func adminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case invalidRuleError:
+		status = http.StatusBadRequest
+	case ruleExistsError:
+		status = http.StatusConflict
+	}
+	if err == errRulesNotLoaded {
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func adminAuth(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// suppressReasonsAnnotation lists, comma separated, the event reasons that
+// should not be forwarded for the annotated namespace or workload ("*"
+// suppresses every reason).
+const suppressReasonsAnnotation = "kube-event-watcher.io/suppress-reasons"
+
+// maxOwnerDepth bounds the walk up controller references, e.g.
+// Pod -> ReplicaSet -> Deployment.
+const maxOwnerDepth = 3
+
+// annotationFilter lets application teams mute their own event noise by
+// annotating namespaces or workloads. Annotations are read from informer
+// caches of namespaces and the common workload kinds; for an event the
+// involved object and its controllers up the owner chain are consulted.
+type annotationFilter struct {
+	namespaces cache.Store
+	// objects holds a store per namespaced kind.
+	objects map[string]cache.Store
+
+	// hasSynced reports whether every cache has completed its initial list;
+	// the caches start in the background and can take a while on large
+	// clusters.
+	hasSynced cache.InformerSynced
+}
+
+func newAnnotationFilter(kubeClient clientset.Interface) *annotationFilter {
+	core := kubeClient.CoreV1().RESTClient()
+	apps := kubeClient.AppsV1().RESTClient()
+	batch := kubeClient.BatchV1().RESTClient()
+
+	f := &annotationFilter{objects: map[string]cache.Store{}}
+	var synced []cache.InformerSynced
+	watch := func(client cache.Getter, resource string, namespace string, obj runtime.Object) cache.Store {
+		lw := cache.NewListWatchFromClient(client, resource, namespace, fields.Everything())
+		store, inf := cache.NewInformer(strippedListWatch(lw), obj, resyncPeriod, cache.ResourceEventHandlerFuncs{})
+		go inf.Run(wait.NeverStop)
+		synced = append(synced, inf.HasSynced)
+		trackCache(resource, store)
+		return store
+	}
+	f.namespaces = watch(core, "namespaces", "", &v1.Namespace{})
+	f.objects["Pod"] = watch(core, "pods", v1.NamespaceAll, &v1.Pod{})
+	f.objects["ReplicaSet"] = watch(apps, "replicasets", v1.NamespaceAll, &appsv1.ReplicaSet{})
+	f.objects["Deployment"] = watch(apps, "deployments", v1.NamespaceAll, &appsv1.Deployment{})
+	f.objects["StatefulSet"] = watch(apps, "statefulsets", v1.NamespaceAll, &appsv1.StatefulSet{})
+	f.objects["DaemonSet"] = watch(apps, "daemonsets", v1.NamespaceAll, &appsv1.DaemonSet{})
+	f.objects["Job"] = watch(batch, "jobs", v1.NamespaceAll, &batchv1.Job{})
+	f.hasSynced = allSynced(synced...)
+	return f
+}
+
+func (f *annotationFilter) name() string {
+	return "annotation"
+}
+
+func (f *annotationFilter) allow(event *v1.Event) bool {
+	ref := event.InvolvedObject
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = event.Namespace
+	}
+	if obj, ok, _ := f.namespaces.GetByKey(namespace); ok && suppresses(obj, event.Reason) {
+		return false
+	}
+	return !f.objectSuppresses(ref.Kind, namespace, ref.Name, event.Reason, 0)
+}
+
+func (f *annotationFilter) objectSuppresses(kind, namespace, name, reason string, depth int) bool {
+	store, ok := f.objects[kind]
+	if !ok || depth > maxOwnerDepth {
+		return false
+	}
+	obj, exists, _ := store.GetByKey(namespace + "/" + name)
+	if !exists {
+		return false
+	}
+	if suppresses(obj, reason) {
+		return true
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	for _, owner := range accessor.GetOwnerReferences() {
+		if owner.Controller != nil && *owner.Controller {
+			return f.objectSuppresses(owner.Kind, namespace, owner.Name, reason, depth+1)
+		}
+	}
+	return false
+}
+
+// suppresses reports whether obj's annotations mute the given reason.
+func suppresses(obj interface{}, reason string) bool {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	value, ok := accessor.GetAnnotations()[suppressReasonsAnnotation]
+	if !ok {
+		return false
+	}
+	for _, r := range strings.Split(value, ",") {
+		r = strings.TrimSpace(r)
+		if r == "*" || r == reason {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	cacheObjects = newGauge("kube_event_watcher_cache_objects",
+		"Number of objects held in an enrichment informer cache.", "cache")
+
+	cacheBytes = newGauge("kube_event_watcher_cache_bytes",
+		"Approximate serialized size of the objects held in an enrichment informer cache.", "cache")
+
+	heapAllocBytes = newGauge("kube_event_watcher_heap_alloc_bytes",
+		"Bytes of allocated heap objects, as reported by the Go runtime.")
+
+	heapInuseBytes = newGauge("kube_event_watcher_heap_inuse_bytes",
+		"Bytes in in-use heap spans, as reported by the Go runtime.")
+
+	trackedCachesMu sync.Mutex
+	trackedCaches   = map[string]cache.Store{}
+)
+
+func init() {
+	registerCollector(collectCacheMetrics)
+}
+
+// trackCache exposes the size of an informer cache under the given name.
+func trackCache(name string, store cache.Store) {
+	trackedCachesMu.Lock()
+	trackedCaches[name] = store
+	trackedCachesMu.Unlock()
+}
+
+func collectCacheMetrics() {
+	trackedCachesMu.Lock()
+	defer trackedCachesMu.Unlock()
+	for name, store := range trackedCaches {
+		items := store.List()
+		size := 0
+		for _, item := range items {
+			if s, ok := item.(interface {
+				Size() int
+			}); ok {
+				size += s.Size()
+			}
+		}
+		cacheObjects.set(float64(len(items)), name)
+		cacheBytes.set(float64(size), name)
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	heapAllocBytes.set(float64(ms.HeapAlloc))
+	heapInuseBytes.set(float64(ms.HeapInuse))
+}
+
+// strippedListWatch wraps lw so that objects are trimmed before they reach
+// the informer cache. The enrichment caches only ever look at metadata
+// (plus a pod's node), so on clusters with tens of thousands of pods
+// dropping spec, status, managedFields and bulky annotations is the
+// difference between a few hundred MB and a few GB of heap.
+func strippedListWatch(lw *cache.ListWatch) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (kruntime.Object, error) {
+			list, err := lw.List(options)
+			if err != nil {
+				return list, err
+			}
+			err = meta.EachListItem(list, func(obj kruntime.Object) error {
+				stripObject(obj)
+				return nil
+			})
+			return list, err
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			w, err := lw.Watch(options)
+			if err != nil {
+				return w, err
+			}
+			return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+				if e.Object != nil {
+					stripObject(e.Object)
+				}
+				return e, true
+			}), nil
+		},
+	}
+}
+
+func stripObject(obj kruntime.Object) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	accessor.SetManagedFields(nil)
+	if annotations := accessor.GetAnnotations(); len(annotations) > 0 {
+		for k, v := range annotations {
+			if k == suppressReasonsAnnotation {
+				continue
+			}
+			if *cacheMaxAnnotationBytes >= 0 && len(v) > *cacheMaxAnnotationBytes {
+				delete(annotations, k)
+			}
+		}
+		accessor.SetAnnotations(annotations)
+	}
+
+	switch o := obj.(type) {
+	case *v1.Pod:
+		o.Spec = v1.PodSpec{NodeName: o.Spec.NodeName}
+		o.Status = v1.PodStatus{}
+	case *v1.Namespace:
+		o.Spec = v1.NamespaceSpec{}
+	case *appsv1.ReplicaSet:
+		o.Spec = appsv1.ReplicaSetSpec{}
+		o.Status = appsv1.ReplicaSetStatus{}
+	case *appsv1.Deployment:
+		o.Spec = appsv1.DeploymentSpec{}
+		o.Status = appsv1.DeploymentStatus{}
+	case *appsv1.StatefulSet:
+		o.Spec = appsv1.StatefulSetSpec{}
+		o.Status = appsv1.StatefulSetStatus{}
+	case *appsv1.DaemonSet:
+		o.Spec = appsv1.DaemonSetSpec{}
+		o.Status = appsv1.DaemonSetStatus{}
+	case *batchv1.Job:
+		o.Spec = batchv1.JobSpec{}
+		o.Status = batchv1.JobStatus{}
+	}
+}
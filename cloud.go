@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+)
+
+// CloudMetadata identifies the cloud account and region the cluster runs
+// in. It is attached to every payload so a central receiver can segment
+// events without joining against its own inventory.
+type CloudMetadata struct {
+	Provider string `json:"provider,omitempty"`
+
+	Region string `json:"region,omitempty"`
+
+	Zone string `json:"zone,omitempty"`
+
+	// Account is the AWS account, GCP project or Azure subscription.
+	Account string `json:"account,omitempty"`
+}
+
+// cloudMetadata is discovered once at startup; nil when disabled.
+var cloudMetadata *CloudMetadata
+
+var regionLabels = []string{
+	"topology.kubernetes.io/region",
+	"failure-domain.beta.kubernetes.io/region",
+}
+
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+// awsZonePattern matches regular availability zones, "<region><letter>".
+// Local and Wavelength zones (e.g. "us-west-2-lax-1a") do not follow it and
+// leave the region to the topology labels or the metadata service.
+var awsZonePattern = regexp.MustCompile(`^([a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-[0-9]+)[a-z]$`)
+
+// discoverCloudMetadata derives the metadata from a node's provider ID and
+// topology labels, optionally completes it from the instance metadata
+// service, and finally applies explicit overrides.
+func discoverCloudMetadata(kubeClient clientset.Interface, useIMDS bool, overrides CloudMetadata) *CloudMetadata {
+	md := &CloudMetadata{}
+	nodes, err := kubeClient.CoreV1().Nodes().List(metav1.ListOptions{Limit: 10})
+	if err != nil {
+		log.Printf("list nodes for cloud metadata error: %v", err)
+	} else {
+		for i := range nodes.Items {
+			if fromNode(md, &nodes.Items[i]) {
+				break
+			}
+		}
+	}
+	if useIMDS {
+		fromIMDS(md)
+	}
+	mergeCloudMetadata(md, overrides)
+	log.Printf("cloud metadata: provider=%q region=%q zone=%q account=%q", md.Provider, md.Region, md.Zone, md.Account)
+	return md
+}
+
+// fromNode fills md from node and reports whether a provider was found.
+func fromNode(md *CloudMetadata, node *v1.Node) bool {
+	parseProviderID(md, node.Spec.ProviderID)
+	// Topology labels are authoritative over what the provider ID implies.
+	for _, l := range regionLabels {
+		if v := node.Labels[l]; v != "" {
+			md.Region = v
+			break
+		}
+	}
+	for _, l := range zoneLabels {
+		if v := node.Labels[l]; v != "" {
+			md.Zone = v
+			break
+		}
+	}
+	return md.Provider != ""
+}
+
+// parseProviderID understands the provider ID formats of the common cloud
+// controllers:
+//
+//	aws:///us-east-1a/i-0123456789abcdef0
+//	aws:///us-west-2-lax-1a/i-0123456789abcdef0 (Local Zone, region unknown)
+//	gce://my-project/us-central1-a/instance-1
+//	azure:///subscriptions/<id>/resourceGroups/<rg>/providers/...
+//	alicloud://cn-hangzhou.i-bp1234567890 (or without the scheme)
+func parseProviderID(md *CloudMetadata, providerID string) {
+	scheme := ""
+	rest := providerID
+	if i := strings.Index(providerID, "://"); i >= 0 {
+		scheme, rest = providerID[:i], providerID[i+3:]
+	}
+	parts := strings.Split(strings.TrimPrefix(rest, "/"), "/")
+	switch scheme {
+	case "aws":
+		md.Provider = "aws"
+		if len(parts) == 2 && parts[0] != "" {
+			md.Zone = parts[0]
+			if m := awsZonePattern.FindStringSubmatch(parts[0]); m != nil {
+				md.Region = m[1]
+			}
+		}
+	case "gce":
+		md.Provider = "gcp"
+		if len(parts) == 3 {
+			md.Account, md.Zone = parts[0], parts[1]
+			if i := strings.LastIndex(parts[1], "-"); i > 0 {
+				md.Region = parts[1][:i]
+			}
+		}
+	case "azure":
+		md.Provider = "azure"
+		if len(parts) > 1 && strings.EqualFold(parts[0], "subscriptions") {
+			md.Account = parts[1]
+		}
+	case "alicloud", "":
+		// Alibaba Cloud uses "<region>.<instance-id>", scheme optional.
+		if i := strings.Index(rest, ".i-"); i > 0 && !strings.Contains(rest, "/") {
+			md.Provider = "alicloud"
+			md.Region = rest[:i]
+		}
+	}
+}
+
+var imdsClient = &http.Client{Timeout: 2 * time.Second}
+
+// fromIMDS completes md from the metadata service of the instance the
+// watcher runs on. Only empty fields are filled in. When the provider is
+// still unknown each service is probed in turn.
+func fromIMDS(md *CloudMetadata) {
+	probes := []struct {
+		provider string
+		query    func(*CloudMetadata) error
+	}{
+		{"aws", awsIdentity},
+		{"gcp", gcpIdentity},
+		{"azure", azureIdentity},
+	}
+	for _, p := range probes {
+		if md.Provider != "" && md.Provider != p.provider {
+			continue
+		}
+		var found CloudMetadata
+		if err := p.query(&found); err != nil {
+			if md.Provider != "" {
+				log.Printf("query %s instance metadata error: %v", p.provider, err)
+			}
+			continue
+		}
+		mergeCloudMetadata(&found, *md)
+		*md = found
+		return
+	}
+}
+
+// mergeCloudMetadata overwrites fields of md with the non-empty fields of from.
+func mergeCloudMetadata(md *CloudMetadata, from CloudMetadata) {
+	if from.Provider != "" {
+		md.Provider = from.Provider
+	}
+	if from.Region != "" {
+		md.Region = from.Region
+	}
+	if from.Zone != "" {
+		md.Zone = from.Zone
+	}
+	if from.Account != "" {
+		md.Account = from.Account
+	}
+}
+
+func imdsGet(method, url string, header map[string]string) ([]byte, error) {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+	resp, err := imdsClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return body, nil
+}
+
+func awsIdentity(md *CloudMetadata) error {
+	// IMDSv2: fetch a session token first.
+	token, err := imdsGet("PUT", "http://169.254.169.254/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return err
+	}
+	body, err := imdsGet("GET", "http://169.254.169.254/latest/dynamic/instance-identity/document",
+		map[string]string{"X-aws-ec2-metadata-token": string(token)})
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		AccountID        string `json:"accountId"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+	*md = CloudMetadata{Provider: "aws", Account: doc.AccountID, Region: doc.Region, Zone: doc.AvailabilityZone}
+	return nil
+}
+
+func gcpIdentity(md *CloudMetadata) error {
+	header := map[string]string{"Metadata-Flavor": "Google"}
+	project, err := imdsGet("GET", "http://metadata.google.internal/computeMetadata/v1/project/project-id", header)
+	if err != nil {
+		return err
+	}
+	*md = CloudMetadata{Provider: "gcp", Account: string(project)}
+	// The zone comes back as "projects/<number>/zones/<zone>".
+	if zone, err := imdsGet("GET", "http://metadata.google.internal/computeMetadata/v1/instance/zone", header); err == nil {
+		z := string(zone)
+		md.Zone = z[strings.LastIndex(z, "/")+1:]
+		if i := strings.LastIndex(md.Zone, "-"); i > 0 {
+			md.Region = md.Zone[:i]
+		}
+	}
+	return nil
+}
+
+func azureIdentity(md *CloudMetadata) error {
+	body, err := imdsGet("GET", "http://169.254.169.254/metadata/instance/compute?api-version=2021-02-01",
+		map[string]string{"Metadata": "true"})
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		SubscriptionID string `json:"subscriptionId"`
+		Location       string `json:"location"`
+		Zone           string `json:"zone"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+	*md = CloudMetadata{Provider: "azure", Account: doc.SubscriptionID, Region: doc.Location, Zone: doc.Zone}
+	return nil
+}
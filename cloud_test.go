@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseProviderID(t *testing.T) {
+	tests := []struct {
+		providerID string
+		want       CloudMetadata
+	}{
+		{"aws:///us-east-1a/i-0123456789abcdef0", CloudMetadata{Provider: "aws", Region: "us-east-1", Zone: "us-east-1a"}},
+		{"aws:///ap-southeast-2c/i-0123456789abcdef0", CloudMetadata{Provider: "aws", Region: "ap-southeast-2", Zone: "ap-southeast-2c"}},
+		{"aws:///us-gov-west-1b/i-0123456789abcdef0", CloudMetadata{Provider: "aws", Region: "us-gov-west-1", Zone: "us-gov-west-1b"}},
+		// Local and Wavelength zones do not end in "<region><letter>".
+		{"aws:///us-west-2-lax-1a/i-0123456789abcdef0", CloudMetadata{Provider: "aws", Zone: "us-west-2-lax-1a"}},
+		{"aws:///us-east-1-wl1-bos-wlz-1/i-0123456789abcdef0", CloudMetadata{Provider: "aws", Zone: "us-east-1-wl1-bos-wlz-1"}},
+		{"aws:///i-0123456789abcdef0", CloudMetadata{Provider: "aws"}},
+		{"gce://my-project/us-central1-a/instance-1", CloudMetadata{Provider: "gcp", Account: "my-project", Region: "us-central1", Zone: "us-central1-a"}},
+		{"gce://my-project/instance-1", CloudMetadata{Provider: "gcp"}},
+		{"azure:///subscriptions/1234-5678/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-0", CloudMetadata{Provider: "azure", Account: "1234-5678"}},
+		{"alicloud://cn-hangzhou.i-bp1234567890", CloudMetadata{Provider: "alicloud", Region: "cn-hangzhou"}},
+		{"cn-beijing.i-2ze1234567890", CloudMetadata{Provider: "alicloud", Region: "cn-beijing"}},
+		{"", CloudMetadata{}},
+		{"kind://docker/kind/kind-control-plane", CloudMetadata{}},
+		{"openstack:///0b4e0f5a-1234", CloudMetadata{}},
+	}
+	for _, tt := range tests {
+		var got CloudMetadata
+		parseProviderID(&got, tt.providerID)
+		if got != tt.want {
+			t.Errorf("parseProviderID(%q) = %+v, want %+v", tt.providerID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var eventsDropped = newCounter("kube_event_watcher_events_dropped_total",
+	"Number of events given up on without being delivered.", "cause")
+
+// deliverer posts DomeosEvents to the DomeOS server from a pool of workers.
+// A 429 or 503 response is treated as a throttling signal: every worker is
+// paused for the duration the server asked for (Retry-After) or, if it did
+// not say, for an exponentially growing backoff.
+//
+// Events matching the critical rules go through a separate queue that
+// workers always drain first, so they overtake a backlog of bulk events,
+// and they skip the offline buffer while it holds a backlog.
+type deliverer struct {
+	url      string
+	client   *http.Client
+	encoder  *payloadEncoder
+	signer   *payloadSigner
+	queue    chan DomeosEvent
+	critical chan DomeosEvent
+	spool    *spool
+
+	criticalReasons map[string]bool
+	criticalTypes   map[string]bool
+	// dropOnFullQueue drops bulk overflow when there is no spool for it.
+	dropOnFullQueue bool
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+	backoff     time.Duration
+}
+
+func newDeliverer(url string, client *http.Client, encoder *payloadEncoder) *deliverer {
+	return &deliverer{
+		url:             url,
+		client:          client,
+		encoder:         encoder,
+		queue:           make(chan DomeosEvent, *queueSize),
+		critical:        make(chan DomeosEvent, *queueSize),
+		criticalReasons: toSet(*criticalReasons),
+		criticalTypes:   toSet(*criticalTypes),
+		dropOnFullQueue: *dropOnFullQueue,
+	}
+}
+
+func toSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// enqueue hands an event to the delivery workers. It blocks while the queue
+// is full so that a slow receiver pushes back on the informer instead of
+// events being dropped. Bulk overflow that would also hold up critical
+// events goes to the offline buffer when there is one, or is dropped when
+// the user opted into that.
+func (d *deliverer) enqueue(de DomeosEvent) {
+	if d.isCritical(de) {
+		d.critical <- de
+		return
+	}
+	if d.spool == nil && !d.dropOnFullQueue {
+		d.queue <- de
+		return
+	}
+	select {
+	case d.queue <- de:
+		return
+	default:
+	}
+	if d.spool == nil {
+		eventsDropped.inc("queue-full")
+		log.Printf("dropping event %s/%s: delivery queue is full", de.K8sEvent.Namespace, de.K8sEvent.Name)
+		return
+	}
+	eventstr, err := d.encoder.encode(de)
+	if err != nil {
+		log.Println("encode DomeosEvent error: ", err)
+		return
+	}
+	d.buffer(eventstr)
+}
+
+func (d *deliverer) isCritical(de DomeosEvent) bool {
+	return d.criticalReasons[de.K8sEvent.Reason] || d.criticalTypes[de.K8sEvent.Type]
+}
+
+func (d *deliverer) queueLengths() {
+	queueLength.set(float64(len(d.queue)), "bulk")
+	queueLength.set(float64(len(d.critical)), "critical")
+}
+
+func (d *deliverer) run(n int) {
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		go d.worker()
+	}
+}
+
+func (d *deliverer) worker() {
+	for {
+		select {
+		case de := <-d.critical:
+			d.deliver(de)
+			continue
+		default:
+		}
+		select {
+		case de := <-d.critical:
+			d.deliver(de)
+		case de := <-d.queue:
+			d.deliver(de)
+		}
+	}
+}
+
+// deliver sends a single event, retrying throttled attempts until the retry
+// budget is spent. With an offline buffer configured, events that cannot
+// reach the receiver or exhaust the retry budget are spooled to disk, and
+// while the spool holds anything new bulk events queue up behind it to keep
+// delivery in order. Critical events are always tried directly.
+func (d *deliverer) deliver(de DomeosEvent) {
+	eventstr, err := d.encoder.encode(de)
+	if err != nil {
+		log.Println("encode DomeosEvent error: ", err)
+		return
+	}
+	if d.spool != nil && d.spool.pending() && !d.isCritical(de) {
+		d.buffer(eventstr)
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		d.waitIfPaused()
+		retryAfter, result := d.post(eventstr)
+		switch result {
+		case postUnreachable:
+			if d.spool != nil {
+				d.buffer(eventstr)
+				return
+			}
+			eventsDropped.inc("unreachable")
+			log.Printf("dropping event %s/%s: DomeOS server unreachable", de.K8sEvent.Namespace, de.K8sEvent.Name)
+			return
+		case postThrottled:
+			d.pause(retryAfter)
+			if attempt >= *retryBudget {
+				if d.spool != nil {
+					d.buffer(eventstr)
+					return
+				}
+				eventsDropped.inc("throttled")
+				log.Printf("dropping event %s/%s: still throttled after %d retries", de.K8sEvent.Namespace, de.K8sEvent.Name, attempt)
+				return
+			}
+		default:
+			d.resetBackoff()
+			return
+		}
+	}
+}
+
+func (d *deliverer) buffer(body []byte) {
+	if err := d.spool.append(body); err != nil {
+		eventsDropped.inc("offline-buffer")
+		log.Printf("dropping event: offline buffer: %v", err)
+	}
+}
+
+type postResult int
+
+const (
+	postDone postResult = iota
+	postThrottled
+	postUnreachable
+)
+
+// post performs one delivery attempt. For postThrottled it also returns how
+// long the receiver asked us to back off (zero when no Retry-After was
+// given).
+func (d *deliverer) post(body []byte) (time.Duration, postResult) {
+	request, err := http.NewRequest("POST", d.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("create request error: %v", err)
+		return 0, postDone
+	}
+	request.Header.Set("Content-Type", *payloadContentType)
+	if d.signer != nil {
+		// Signed per attempt so retries carry a fresh timestamp.
+		d.signer.sign(request, body, time.Now())
+	}
+
+	resp, err := d.client.Do(request)
+	if err != nil {
+		log.Printf("get response error, %v", err)
+		return 0, postUnreachable
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		log.Printf("http.Do failed,[err=%s][url=%s]", err, d.url)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		log.Printf("DomeOS server throttled delivery (%s), retry after %v", resp.Status, retryAfter)
+		return retryAfter, postThrottled
+	}
+	return 0, postDone
+}
+
+// flushSpool drains the offline buffer oldest first once the receiver is
+// reachable again, limited to bytesPerSecond so a long outage does not
+// saturate a thin uplink when it comes back.
+func (d *deliverer) flushSpool(interval time.Duration, bytesPerSecond int) {
+	for range time.Tick(interval) {
+		for d.spool.pending() {
+			body, err := d.spool.peek()
+			if err != nil {
+				log.Printf("read offline buffer error: %v", err)
+				break
+			}
+			d.waitIfPaused()
+			start := time.Now()
+			retryAfter, result := d.post(body)
+			if result == postUnreachable {
+				break
+			}
+			if result == postThrottled {
+				d.pause(retryAfter)
+				continue
+			}
+			d.resetBackoff()
+			if err := d.spool.commit(); err != nil {
+				log.Printf("commit offline buffer error: %v", err)
+				break
+			}
+			if bytesPerSecond > 0 {
+				budget := time.Duration(len(body)) * time.Second / time.Duration(bytesPerSecond)
+				time.Sleep(budget - time.Since(start))
+			}
+		}
+	}
+}
+
+// pause stops all workers for retryAfter, or for the current backoff step
+// when the server did not specify a duration. The computed backoff is
+// capped by --max-retry-backoff and an explicit Retry-After by the larger
+// --max-retry-after, so a bogus header cannot stall delivery indefinitely.
+func (d *deliverer) pause(retryAfter time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if retryAfter > *maxRetryAfter {
+		retryAfter = *maxRetryAfter
+	}
+	if retryAfter <= 0 {
+		if d.backoff == 0 {
+			d.backoff = *retryBackoff
+		} else {
+			d.backoff *= 2
+		}
+		if d.backoff > *maxRetryBackoff {
+			d.backoff = *maxRetryBackoff
+		}
+		retryAfter = d.backoff
+	}
+	if until := time.Now().Add(retryAfter); until.After(d.pausedUntil) {
+		d.pausedUntil = until
+	}
+}
+
+func (d *deliverer) resetBackoff() {
+	d.mu.Lock()
+	d.backoff = 0
+	d.mu.Unlock()
+}
+
+func (d *deliverer) waitIfPaused() {
+	for {
+		d.mu.Lock()
+		wait := time.Until(d.pausedUntil)
+		d.mu.Unlock()
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// parseRetryAfter understands both forms allowed by RFC 7231: a number of
+// seconds or an HTTP date. Unparseable or past values yield zero; values
+// too large for a Duration saturate.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil || isRangeError(err) {
+		if secs < 0 {
+			return 0
+		}
+		if secs > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func isRangeError(err error) bool {
+	numErr, ok := err.(*strconv.NumError)
+	return ok && numErr.Err == strconv.ErrRange
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{"300", 5 * time.Minute},
+		{"-5", 0},
+		{"99999999999", math.MaxInt64},
+		{"9223372036", 9223372036 * time.Second},
+		{"9223372037", math.MaxInt64},
+		{"99999999999999999999", math.MaxInt64},
+		{"-99999999999999999999", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestPauseHonorsLongRetryAfter(t *testing.T) {
+	d := &deliverer{}
+	d.pause(5 * time.Minute)
+	if wait := time.Until(d.pausedUntil); wait < 4*time.Minute {
+		t.Errorf("paused for %v, want the full Retry-After of 5m", wait)
+	}
+}
+
+func TestPauseClampsRetryAfter(t *testing.T) {
+	d := &deliverer{}
+	d.pause(parseRetryAfter("9223372037", time.Now()))
+	wait := time.Until(d.pausedUntil)
+	if wait <= 0 || wait > *maxRetryAfter {
+		t.Errorf("paused for %v, want at most --max-retry-after %v", wait, *maxRetryAfter)
+	}
+}
+
+func TestPauseCapsComputedBackoff(t *testing.T) {
+	d := &deliverer{}
+	for i := 0; i < 20; i++ {
+		d.pause(0)
+	}
+	if d.backoff != *maxRetryBackoff {
+		t.Errorf("backoff = %v, want cap %v", d.backoff, *maxRetryBackoff)
+	}
+}
+
+func TestEnqueueBlocksOnFullQueueByDefault(t *testing.T) {
+	d := &deliverer{
+		queue:           make(chan DomeosEvent, 1),
+		critical:        make(chan DomeosEvent, 1),
+		criticalReasons: map[string]bool{"OOMKilling": true},
+	}
+	bulk := DomeosEvent{K8sEvent: v1.Event{Reason: "Pulled"}}
+	d.enqueue(bulk)
+
+	done := make(chan struct{})
+	go func() {
+		d.enqueue(bulk)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("enqueue on a full queue returned instead of waiting")
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-d.queue
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue still blocked after the queue drained")
+	}
+	if len(d.queue) != 1 {
+		t.Errorf("bulk queue holds %d events, want 1", len(d.queue))
+	}
+}
+
+func TestEnqueueOverflowsBulkWithoutBlocking(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &deliverer{
+		encoder:         &payloadEncoder{},
+		queue:           make(chan DomeosEvent, 1),
+		critical:        make(chan DomeosEvent, 1),
+		criticalReasons: map[string]bool{"OOMKilling": true},
+		dropOnFullQueue: true,
+	}
+	bulk := DomeosEvent{K8sEvent: v1.Event{Reason: "Pulled"}}
+
+	// Opted into dropping, without an offline buffer the overflow is lost.
+	d.enqueue(bulk)
+	d.enqueue(bulk)
+	if len(d.queue) != 1 {
+		t.Fatalf("bulk queue holds %d events, want 1", len(d.queue))
+	}
+
+	d.spool, d.dropOnFullQueue = s, false
+	d.enqueue(bulk)
+	if !s.pending() {
+		t.Error("bulk overflow was not spooled")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.enqueue(DomeosEvent{K8sEvent: v1.Event{Reason: "OOMKilling"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("critical enqueue blocked behind the full bulk queue")
+	}
+}
+
+func TestCriticalBypassesSpool(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, "backlog")
+	d := &deliverer{
+		url:             server.URL,
+		client:          server.Client(),
+		encoder:         &payloadEncoder{},
+		spool:           s,
+		criticalReasons: map[string]bool{"OOMKilling": true},
+	}
+
+	d.deliver(DomeosEvent{K8sEvent: v1.Event{Reason: "Pulled"}})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 0 {
+		t.Fatalf("bulk event was delivered ahead of the spool backlog")
+	}
+	mu.Unlock()
+	d.deliver(DomeosEvent{K8sEvent: v1.Event{Reason: "OOMKilling"}})
+	mu.Lock()
+	if len(received) != 1 || !strings.Contains(received[0], "OOMKilling") {
+		t.Fatalf("received %q, want the critical event", received)
+	}
+	expectRecords(t, drain(t, s), "backlog", string(mustEncode(t, d, "Pulled")))
+}
+
+func mustEncode(t *testing.T, d *deliverer, reason string) []byte {
+	body, err := d.encoder.encode(DomeosEvent{K8sEvent: v1.Event{Reason: reason}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
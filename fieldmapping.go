@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// fieldMapping reshapes the JSON form of a DomeosEvent so it matches a
+// downstream schema. Paths are dotted JSON keys, e.g.
+// "k8sEvent.involvedObject.name". The steps run in the order of the
+// fields below.
+type fieldMapping struct {
+	// Flatten lifts the children of each listed object into its parent,
+	// prefixing their keys with the object's key and Separator.
+	Flatten []string `json:"flatten"`
+
+	// Separator joins flattened keys; defaults to "_".
+	Separator *string `json:"separator"`
+
+	// Rename moves the value at each source path to the destination path,
+	// creating intermediate objects as needed. Renames apply in order, so
+	// one may move a value another has just written.
+	Rename []fieldRename `json:"rename"`
+
+	// Drop removes the listed paths.
+	Drop []string `json:"drop"`
+
+	// DropNulls removes null values at any depth.
+	DropNulls bool `json:"dropNulls"`
+}
+
+type fieldRename struct {
+	From string `json:"from"`
+
+	To string `json:"to"`
+}
+
+// loadFieldMapping reads a field mapping from a YAML or JSON file.
+func loadFieldMapping(path string) (*fieldMapping, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &fieldMapping{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parse field mapping %s: %v", path, err)
+	}
+	for _, r := range m.Rename {
+		if r.From == "" || r.To == "" {
+			return nil, fmt.Errorf("field mapping %s: rename needs both from and to", path)
+		}
+	}
+	return m, nil
+}
+
+func (m *fieldMapping) separator() string {
+	if m.Separator == nil {
+		return "_"
+	}
+	return *m.Separator
+}
+
+// apply marshals v, reshapes it and returns the resulting JSON.
+func (m *fieldMapping) apply(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	for _, path := range m.Flatten {
+		flatten(doc, splitPath(path), m.separator())
+	}
+	for _, r := range m.Rename {
+		if value, ok := removePath(doc, splitPath(r.From)); ok {
+			setPath(doc, splitPath(r.To), value)
+		}
+	}
+	for _, path := range m.Drop {
+		removePath(doc, splitPath(path))
+	}
+	if m.DropNulls {
+		dropNulls(doc)
+	}
+	return json.Marshal(doc)
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "."), ".")
+}
+
+// parentOf returns the object holding the last element of path, or nil.
+func parentOf(doc map[string]interface{}, path []string) map[string]interface{} {
+	cur := doc
+	for _, key := range path[:len(path)-1] {
+		next, ok := cur[key].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = next
+	}
+	return cur
+}
+
+func removePath(doc map[string]interface{}, path []string) (interface{}, bool) {
+	parent := parentOf(doc, path)
+	if parent == nil {
+		return nil, false
+	}
+	key := path[len(path)-1]
+	value, ok := parent[key]
+	delete(parent, key)
+	return value, ok
+}
+
+func setPath(doc map[string]interface{}, path []string, value interface{}) {
+	cur := doc
+	for _, key := range path[:len(path)-1] {
+		next, ok := cur[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			cur[key] = next
+		}
+		cur = next
+	}
+	cur[path[len(path)-1]] = value
+}
+
+func flatten(doc map[string]interface{}, path []string, sep string) {
+	parent := parentOf(doc, path)
+	if parent == nil {
+		return
+	}
+	key := path[len(path)-1]
+	obj, ok := parent[key].(map[string]interface{})
+	if !ok {
+		return
+	}
+	delete(parent, key)
+	for child, value := range obj {
+		parent[key+sep+child] = value
+	}
+}
+
+func dropNulls(v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if child == nil {
+				delete(t, k)
+				continue
+			}
+			dropNulls(child)
+		}
+	case []interface{}:
+		for _, child := range t {
+			dropNulls(child)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFieldMappingApply(t *testing.T) {
+	dot := "."
+	input := map[string]interface{}{
+		"clusterId": 7,
+		"k8sEvent": map[string]interface{}{
+			"reason": "BackOff",
+			"involvedObject": map[string]interface{}{
+				"kind": "Pod",
+				"name": "web-0",
+			},
+			"series": nil,
+		},
+		"incident": nil,
+	}
+	tests := []struct {
+		name    string
+		mapping fieldMapping
+		want    string
+	}{
+		{
+			name:    "empty mapping",
+			mapping: fieldMapping{},
+			want:    `{"clusterId":7,"incident":null,"k8sEvent":{"involvedObject":{"kind":"Pod","name":"web-0"},"reason":"BackOff","series":null}}`,
+		},
+		{
+			name:    "flatten",
+			mapping: fieldMapping{Flatten: []string{"k8sEvent.involvedObject"}},
+			want:    `{"clusterId":7,"incident":null,"k8sEvent":{"involvedObject_kind":"Pod","involvedObject_name":"web-0","reason":"BackOff","series":null}}`,
+		},
+		{
+			name:    "flatten with separator",
+			mapping: fieldMapping{Flatten: []string{"k8sEvent"}, Separator: &dot},
+			want:    `{"clusterId":7,"incident":null,"k8sEvent.involvedObject":{"kind":"Pod","name":"web-0"},"k8sEvent.reason":"BackOff","k8sEvent.series":null}`,
+		},
+		{
+			name: "rename creates parents",
+			mapping: fieldMapping{Rename: []fieldRename{
+				{From: "k8sEvent.reason", To: "meta.reason"},
+			}},
+			want: `{"clusterId":7,"incident":null,"k8sEvent":{"involvedObject":{"kind":"Pod","name":"web-0"},"series":null},"meta":{"reason":"BackOff"}}`,
+		},
+		{
+			name: "renames apply in order",
+			mapping: fieldMapping{Rename: []fieldRename{
+				{From: "clusterId", To: "cluster"},
+				{From: "cluster", To: "meta.cluster"},
+			}},
+			want: `{"incident":null,"k8sEvent":{"involvedObject":{"kind":"Pod","name":"web-0"},"reason":"BackOff","series":null},"meta":{"cluster":7}}`,
+		},
+		{
+			name: "rename of a missing path is a no-op",
+			mapping: fieldMapping{Rename: []fieldRename{
+				{From: "k8sEvent.missing", To: "meta.missing"},
+			}},
+			want: `{"clusterId":7,"incident":null,"k8sEvent":{"involvedObject":{"kind":"Pod","name":"web-0"},"reason":"BackOff","series":null}}`,
+		},
+		{
+			name:    "drop",
+			mapping: fieldMapping{Drop: []string{"clusterId", "k8sEvent.involvedObject.kind", "no.such.path"}},
+			want:    `{"incident":null,"k8sEvent":{"involvedObject":{"name":"web-0"},"reason":"BackOff","series":null}}`,
+		},
+		{
+			name:    "drop nulls at any depth",
+			mapping: fieldMapping{DropNulls: true},
+			want:    `{"clusterId":7,"k8sEvent":{"involvedObject":{"kind":"Pod","name":"web-0"},"reason":"BackOff"}}`,
+		},
+		{
+			name: "steps run flatten, rename, drop, dropNulls",
+			mapping: fieldMapping{
+				Flatten:   []string{"k8sEvent.involvedObject"},
+				Rename:    []fieldRename{{From: "k8sEvent.involvedObject_name", To: "object"}},
+				Drop:      []string{"k8sEvent.involvedObject_kind"},
+				DropNulls: true,
+			},
+			want: `{"clusterId":7,"k8sEvent":{"reason":"BackOff"},"object":"web-0"}`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.mapping.apply(input)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadFieldMappingKeepsRenameOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fieldmapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.yaml")
+	yaml := `
+rename:
+- from: b
+  to: c
+- from: a
+  to: b
+dropNulls: true
+`
+	if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadFieldMapping(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fieldRename{{From: "b", To: "c"}, {From: "a", To: "b"}}
+	if !reflect.DeepEqual(m.Rename, want) || !m.DropNulls {
+		t.Errorf("loaded %+v, want rename %+v and dropNulls", m, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("rename:\n- from: a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFieldMapping(path); err == nil {
+		t.Error("rename without to was accepted")
+	}
+}
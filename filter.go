@@ -0,0 +1,28 @@
+package main
+
+import (
+	"k8s.io/api/core/v1"
+)
+
+var eventsSuppressed = newCounter("kube_event_watcher_events_suppressed_total",
+	"Number of events dropped by a filter instead of being forwarded.", "filter", "namespace", "reason")
+
+// eventFilter is one step of the filter stage that runs before events are
+// handed to the delivery workers.
+type eventFilter interface {
+	name() string
+
+	// allow reports whether the event should be forwarded.
+	allow(event *v1.Event) bool
+}
+
+// runFilters returns false as soon as one filter drops the event.
+func runFilters(filters []eventFilter, event *v1.Event) bool {
+	for _, f := range filters {
+		if !f.allow(event) {
+			eventsSuppressed.inc(f.name(), event.Namespace, event.Reason)
+			return false
+		}
+	}
+	return true
+}
@@ -4,7 +4,9 @@ require (
 	github.com/golang/glog v0.0.0-20141105023935-44145f04b68c // indirect
 	github.com/openshift/origin v0.0.0-20161227054425-72302411f7ae
 	github.com/spf13/pflag v1.0.1
+	golang.org/x/time v0.0.0-20161028155119-f51c12702a4d
 	k8s.io/api v0.0.0-20190620084959-7cf5895f2711
 	k8s.io/apimachinery v0.15.12
 	k8s.io/client-go v0.0.0-20190620085101-78d2af792bab
+	sigs.k8s.io/yaml v1.1.0
 )
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	incidentOpen     = "open"
+	incidentUpdate   = "update"
+	incidentResolved = "resolved"
+)
+
+// Incident describes a run of Warning events with the same reason on the
+// same object. It is attached to DomeosEvents of type "incident".
+type Incident struct {
+	State string `json:"state"`
+
+	Reason string `json:"reason"`
+
+	InvolvedObject v1.ObjectReference `json:"involvedObject"`
+
+	FirstSeen time.Time `json:"firstSeen"`
+
+	LastSeen time.Time `json:"lastSeen"`
+
+	// Count is the number of Warning occurrences seen while open.
+	Count int32 `json:"count"`
+
+	// ResolvedBy is "event" when a configured recovery event on the object
+	// closed the incident and "quiet-period" when it timed out.
+	ResolvedBy string `json:"resolvedBy,omitempty"`
+}
+
+type openIncident struct {
+	Incident
+	lastEvent    v1.Event
+	lastNotified time.Time
+	// counts holds the latest Count of each event folded into the
+	// incident, so repeated updates of one event are not double counted.
+	counts map[types.UID]int32
+}
+
+// incidentTracker turns the raw event stream into open/update/resolved
+// notifications keyed by involved object and reason.
+type incidentTracker struct {
+	emit           func(DomeosEvent)
+	quietPeriod    time.Duration
+	updateInterval time.Duration
+	// resolvers maps a Normal reason to the Warning reasons it resolves.
+	resolvers map[string][]string
+
+	mu sync.Mutex
+	// open incidents by object key, then by reason.
+	open map[string]map[string]*openIncident
+}
+
+func newIncidentTracker(emit func(DomeosEvent), quietPeriod, updateInterval time.Duration, resolvePairs []string) (*incidentTracker, error) {
+	resolvers, err := parseResolvePairs(resolvePairs)
+	if err != nil {
+		return nil, err
+	}
+	t := &incidentTracker{
+		emit:           emit,
+		quietPeriod:    quietPeriod,
+		updateInterval: updateInterval,
+		resolvers:      resolvers,
+		open:           map[string]map[string]*openIncident{},
+	}
+	go t.sweep()
+	return t, nil
+}
+
+// parseResolvePairs parses "<Warning reason>=<Normal reason>" pairs into a
+// map from the Normal reason to the Warning reasons it resolves.
+func parseResolvePairs(pairs []string) (map[string][]string, error) {
+	resolvers := map[string][]string{}
+	for _, p := range pairs {
+		i := strings.Index(p, "=")
+		if i <= 0 || i == len(p)-1 {
+			return nil, fmt.Errorf("invalid incident resolve pair %q, want <Warning reason>=<Normal reason>", p)
+		}
+		warning, normal := p[:i], p[i+1:]
+		resolvers[normal] = append(resolvers[normal], warning)
+	}
+	return resolvers, nil
+}
+
+func objectKey(ref v1.ObjectReference) string {
+	return ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+}
+
+// eventCount returns how many occurrences an event stands for; the
+// apiserver leaves Count at zero for events recorded once.
+func eventCount(event *v1.Event) int32 {
+	if event.Count > 0 {
+		return event.Count
+	}
+	return 1
+}
+
+// eventTimes returns when an event first and last occurred, falling back
+// to now for events that carry no timestamps.
+func eventTimes(event *v1.Event, now time.Time) (first, last time.Time) {
+	last = event.LastTimestamp.Time
+	if last.IsZero() {
+		last = event.EventTime.Time
+	}
+	if last.IsZero() {
+		last = now
+	}
+	first = event.FirstTimestamp.Time
+	if first.IsZero() || first.After(last) {
+		first = last
+	}
+	return first, last
+}
+
+// observe feeds one added or updated event into the tracker. Repeats of a
+// Warning arrive as updates of the same event with a higher Count.
+//
+// replay is set for events of the informer's initial list, which may be
+// hours old: they seed incidents still within the quiet period without
+// notifying, so a restart neither re-announces nor resolves incidents the
+// receiver already knows about.
+func (t *incidentTracker) observe(event *v1.Event, replay bool) {
+	t.emitAll(t.record(event, replay, time.Now()))
+}
+
+func (t *incidentTracker) emitAll(notes []DomeosEvent) {
+	for _, n := range notes {
+		t.emit(n)
+	}
+}
+
+func (t *incidentTracker) record(event *v1.Event, replay bool, now time.Time) []DomeosEvent {
+	var notes []DomeosEvent
+	first, last := eventTimes(event, now)
+	key := objectKey(event.InvolvedObject)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch event.Type {
+	case v1.EventTypeWarning:
+		if replay && now.Sub(last) >= t.quietPeriod {
+			return nil
+		}
+		byReason := t.open[key]
+		if byReason == nil {
+			byReason = map[string]*openIncident{}
+			t.open[key] = byReason
+		}
+		inc, ok := byReason[event.Reason]
+		if !ok {
+			inc = &openIncident{Incident: Incident{
+				State:          incidentOpen,
+				Reason:         event.Reason,
+				InvolvedObject: event.InvolvedObject,
+				FirstSeen:      first,
+				LastSeen:       last,
+			}, counts: map[types.UID]int32{}}
+			byReason[event.Reason] = inc
+		} else {
+			inc.State = incidentUpdate
+		}
+		if first.Before(inc.FirstSeen) {
+			inc.FirstSeen = first
+		}
+		if last.After(inc.LastSeen) {
+			inc.LastSeen = last
+		}
+		inc.Count += eventCount(event) - inc.counts[event.UID]
+		inc.counts[event.UID] = eventCount(event)
+		inc.lastEvent = *event
+		if replay {
+			inc.lastNotified = now
+		} else if !ok || now.Sub(inc.lastNotified) >= t.updateInterval {
+			inc.lastNotified = now
+			notes = append(notes, inc.notification())
+		}
+	case v1.EventTypeNormal:
+		// Only a configured recovery reason closes an incident: a
+		// crash-looping pod emits Pulled/Started between its BackOff
+		// Warnings without having recovered.
+		byReason := t.open[key]
+		if byReason == nil {
+			return nil
+		}
+		for _, reason := range t.resolvers[event.Reason] {
+			inc, ok := byReason[reason]
+			if !ok {
+				continue
+			}
+			if !replay {
+				notes = append(notes, inc.resolve("event"))
+			}
+			delete(byReason, reason)
+		}
+		if len(byReason) == 0 {
+			delete(t.open, key)
+		}
+	}
+	return notes
+}
+
+// sweep resolves incidents that have seen no Warning for the quiet period.
+func (t *incidentTracker) sweep() {
+	interval := t.quietPeriod / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		t.emitAll(t.expire(time.Now()))
+	}
+}
+
+// expire resolves the incidents whose last Warning is a quiet period old.
+func (t *incidentTracker) expire(now time.Time) []DomeosEvent {
+	var notes []DomeosEvent
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, byReason := range t.open {
+		for reason, inc := range byReason {
+			if now.Sub(inc.LastSeen) >= t.quietPeriod {
+				notes = append(notes, inc.resolve("quiet-period"))
+				delete(byReason, reason)
+			}
+		}
+		if len(byReason) == 0 {
+			delete(t.open, key)
+		}
+	}
+	return notes
+}
+
+func (inc *openIncident) resolve(by string) DomeosEvent {
+	inc.State = incidentResolved
+	inc.ResolvedBy = by
+	return inc.notification()
+}
+
+func (inc *openIncident) notification() DomeosEvent {
+	snapshot := inc.Incident
+	return DomeosEvent{
+		K8sEvent:   inc.lastEvent,
+		ClusterId:  *clusterId,
+		ClusterApi: *apiserver,
+		Type:       "incident",
+		Incident:   &snapshot,
+		Cloud:      cloudMetadata,
+	}
+}
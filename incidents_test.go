@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var incidentBase = time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+
+type incidentStep struct {
+	typ, reason string
+	uid         string
+	count       int32
+	// at is when the event last occurred and, unless the step is a
+	// replay, when the tracker sees it.
+	at     time.Duration
+	replay bool
+}
+
+func (s incidentStep) event(kind string) *v1.Event {
+	return &v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{UID: types.UID(s.uid)},
+		InvolvedObject: v1.ObjectReference{Kind: kind, Namespace: "default", Name: "obj"},
+		Type:           s.typ,
+		Reason:         s.reason,
+		Count:          s.count,
+		FirstTimestamp: metav1.NewTime(incidentBase),
+		LastTimestamp:  metav1.NewTime(incidentBase.Add(s.at)),
+	}
+}
+
+func newTestTracker(t *testing.T) *incidentTracker {
+	resolvers, err := parseResolvePairs([]string{"NodeNotReady=NodeReady", "FailedScheduling=Scheduled"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &incidentTracker{
+		quietPeriod:    10 * time.Minute,
+		updateInterval: 5 * time.Minute,
+		resolvers:      resolvers,
+		open:           map[string]map[string]*openIncident{},
+	}
+}
+
+func TestIncidentObserve(t *testing.T) {
+	// Replayed steps are seen by the tracker at now, an hour after base.
+	now := incidentBase.Add(time.Hour)
+	tests := []struct {
+		name  string
+		steps []incidentStep
+		want  []string
+		open  int
+	}{
+		{
+			name:  "warning opens",
+			steps: []incidentStep{{typ: "Warning", reason: "BackOff", uid: "a", count: 1}},
+			want:  []string{"open BackOff 1"},
+			open:  1,
+		},
+		{
+			name: "repeat within the update interval is silent",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "BackOff", uid: "a", count: 1},
+				{typ: "Warning", reason: "BackOff", uid: "a", count: 2, at: time.Minute},
+			},
+			want: []string{"open BackOff 1"},
+			open: 1,
+		},
+		{
+			name: "repeat after the update interval notifies",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "BackOff", uid: "a", count: 1},
+				{typ: "Warning", reason: "BackOff", uid: "a", count: 3, at: 6 * time.Minute},
+			},
+			want: []string{"open BackOff 1", "update BackOff 3"},
+			open: 1,
+		},
+		{
+			name: "unrelated normal events do not resolve",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "BackOff", uid: "a", count: 1},
+				{typ: "Normal", reason: "Pulled", uid: "b", at: time.Second},
+				{typ: "Normal", reason: "Started", uid: "c", at: 2 * time.Second},
+			},
+			want: []string{"open BackOff 1"},
+			open: 1,
+		},
+		{
+			name: "configured recovery resolves",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "FailedScheduling", uid: "a", count: 1},
+				{typ: "Warning", reason: "BackOff", uid: "b", count: 1},
+				{typ: "Normal", reason: "Scheduled", uid: "c", at: time.Minute},
+			},
+			want: []string{"open FailedScheduling 1", "open BackOff 1", "resolved FailedScheduling 1 event"},
+			open: 1,
+		},
+		{
+			name: "replayed stale warning is ignored",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "BackOff", uid: "a", count: 4, replay: true},
+			},
+			open: 0,
+		},
+		{
+			name: "replayed recent warning seeds silently",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "BackOff", uid: "a", count: 4, at: 55 * time.Minute, replay: true},
+			},
+			open: 1,
+		},
+		{
+			name: "seeded incident resolves after sync",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "FailedScheduling", uid: "a", count: 2, at: 55 * time.Minute, replay: true},
+				{typ: "Normal", reason: "Scheduled", uid: "b", at: 61 * time.Minute},
+			},
+			want: []string{"resolved FailedScheduling 2 event"},
+			open: 0,
+		},
+		{
+			name: "replayed recovery resolves silently",
+			steps: []incidentStep{
+				{typ: "Warning", reason: "FailedScheduling", uid: "a", count: 1, at: 55 * time.Minute, replay: true},
+				{typ: "Normal", reason: "Scheduled", uid: "b", at: 56 * time.Minute, replay: true},
+			},
+			open: 0,
+		},
+	}
+	for _, tt := range tests {
+		tracker := newTestTracker(t)
+		var got []string
+		for _, s := range tt.steps {
+			at := incidentBase.Add(s.at)
+			if s.replay {
+				at = now
+			}
+			for _, n := range tracker.record(s.event("Pod"), s.replay, at) {
+				desc := fmt.Sprintf("%s %s %d", n.Incident.State, n.Incident.Reason, n.Incident.Count)
+				if n.Incident.ResolvedBy != "" {
+					desc += " " + n.Incident.ResolvedBy
+				}
+				got = append(got, desc)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: notifications = %q, want %q", tt.name, got, tt.want)
+		}
+		if n := len(tracker.open["Pod/default/obj"]); n != tt.open {
+			t.Errorf("%s: %d incidents open, want %d", tt.name, n, tt.open)
+		}
+	}
+}
+
+func TestIncidentUsesEventTimestamps(t *testing.T) {
+	tracker := newTestTracker(t)
+	step := incidentStep{typ: "Warning", reason: "BackOff", uid: "a", count: 5, at: 3 * time.Minute}
+	notes := tracker.record(step.event("Pod"), false, incidentBase.Add(4*time.Minute))
+	if len(notes) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(notes))
+	}
+	inc := notes[0].Incident
+	if !inc.FirstSeen.Equal(incidentBase) || !inc.LastSeen.Equal(incidentBase.Add(3*time.Minute)) {
+		t.Errorf("seen %v..%v, want the event's timestamps %v..%v", inc.FirstSeen, inc.LastSeen, incidentBase, incidentBase.Add(3*time.Minute))
+	}
+}
+
+func TestIncidentExpire(t *testing.T) {
+	tracker := newTestTracker(t)
+	step := incidentStep{typ: "Warning", reason: "BackOff", uid: "a", count: 1}
+	tracker.record(step.event("Pod"), false, incidentBase)
+
+	if notes := tracker.expire(incidentBase.Add(9 * time.Minute)); len(notes) != 0 {
+		t.Errorf("resolved %d incidents before the quiet period", len(notes))
+	}
+	notes := tracker.expire(incidentBase.Add(10 * time.Minute))
+	if len(notes) != 1 || notes[0].Incident.ResolvedBy != "quiet-period" {
+		t.Fatalf("got %+v, want one incident resolved by quiet-period", notes)
+	}
+	if len(tracker.open) != 0 {
+		t.Errorf("%d objects still tracked after expiry", len(tracker.open))
+	}
+}
+
+func TestParseResolvePairs(t *testing.T) {
+	got, err := parseResolvePairs([]string{"NodeNotReady=NodeReady", "FailedMount=SuccessfulMountVolume", "Rebooted=NodeReady"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"NodeReady":             {"NodeNotReady", "Rebooted"},
+		"SuccessfulMountVolume": {"FailedMount"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResolvePairs = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"NodeNotReady", "=NodeReady", "NodeNotReady="} {
+		if _, err := parseResolvePairs([]string{bad}); err == nil {
+			t.Errorf("parseResolvePairs(%q) succeeded, want an error", bad)
+		}
+	}
+}
@@ -17,14 +17,10 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/openshift/origin/pkg/util/proc"
 	flag "github.com/spf13/pflag"
-	"io/ioutil"
 	"k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/util/wait"
 	clientset "k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
@@ -33,6 +29,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -58,17 +55,107 @@ var (
 	clusterId = flags.Int("clusterId", 0, `The cluster id in DomeOS.`)
 
 	domeosServer = flags.String("domeosServer", "", `The DomeOS server address to report events.`)
+
+	workers = flags.Int("workers", 1, `Number of workers delivering events to the DomeOS server.`)
+
+	queueSize = flags.Int("queue-size", 1000, `Number of events buffered in front of the delivery workers, per queue. When the bulk queue is full the informer waits, unless bulk events can overflow to the offline buffer or --drop-on-full-queue is set.`)
+
+	dropOnFullQueue = flags.Bool("drop-on-full-queue", false, `If true and no offline buffer is configured, drop bulk events that do not fit in the queue instead of waiting, so that critical events are not held up behind them.`)
+
+	criticalReasons = flags.StringSlice("critical-reasons", nil, `Event reasons (comma separated) delivered ahead of the bulk queue, e.g. OOMKilling,NodeNotReady.`)
+
+	criticalTypes = flags.StringSlice("critical-types", nil, `Event types (comma separated, e.g. Warning) delivered ahead of the bulk queue.`)
+
+	retryBudget = flags.Int("retry-budget", 5, `How many times a throttled (429/503) delivery is retried before the event is dropped.`)
+
+	retryBackoff = flags.Duration("retry-backoff", time.Second, `Initial pause after a throttled delivery without a Retry-After header; doubled on every consecutive throttle.`)
+
+	maxRetryBackoff = flags.Duration("max-retry-backoff", time.Minute, `Upper bound for the backoff computed when the DomeOS server throttles without a Retry-After header.`)
+
+	maxRetryAfter = flags.Duration("max-retry-after", 15*time.Minute, `Upper bound for a Retry-After the DomeOS server asks for; longer values are clamped to it.`)
+
+	offlineBufferDir = flags.String("offline-buffer-dir", "", `If set, events that cannot reach the DomeOS server are buffered on disk in this directory and delivered in order once it is reachable again.`)
+
+	offlineBufferMaxBytes = flags.Int64("offline-buffer-max-bytes", 512<<20, `Maximum size of the offline buffer data file; events are dropped when it is full. Compaction briefly needs up to twice this on disk.`)
+
+	offlineRetryInterval = flags.Duration("offline-retry-interval", 10*time.Second, `How often delivery of the offline buffer is attempted.`)
+
+	offlineFlushRate = flags.Int("offline-flush-rate", 256<<10, `Bytes per second sent when flushing the offline buffer; 0 for unlimited.`)
+
+	pushGateway = flags.String("push-gateway", "", `If set, periodically push event-rate metrics to this Pushgateway URL instead of relying on scraping.`)
+
+	pushInterval = flags.Duration("push-interval", 30*time.Second, `Interval between metric pushes to the Pushgateway.`)
+
+	pushJob = flags.String("push-job", "kube_event_watcher", `Job name used when pushing metrics to the Pushgateway.`)
+
+	nodeLocal = flags.Bool("node-local", false, `If true, only forward the events the local node's kubelet reports, for running as a DaemonSet. Pair with one --node-local-remainder instance.`)
+
+	nodeLocalRemainder = flags.Bool("node-local-remainder", false, `If true, only forward the events --node-local instances do not: those not reported by a kubelet, including node controller events about Nodes. Run as a single-replica Deployment next to the --node-local DaemonSet.`)
+
+	nodeName = flags.String("node-name", os.Getenv("NODE_NAME"), `Name of the node this instance runs on in --node-local mode. Defaults to $NODE_NAME.`)
+
+	payloadTemplate = flags.String("payload-template", "", `Path to a Go text/template rendering the request body from each DomeosEvent, e.g. for Slack-style receivers. Defaults to the plain JSON event.`)
+
+	fieldMappingFile = flags.String("field-mapping", "", `Path to a YAML/JSON field mapping (flatten, rename, drop, dropNulls) applied to the JSON payload. Ignored with --payload-template.`)
+
+	payloadContentType = flags.String("payload-content-type", "application/json;charset=UTF-8", `Content-Type header sent with each delivery.`)
+
+	clientCert = flags.String("client-cert", "", `Client certificate (PEM) presented to the DomeOS server for mutual TLS.`)
+
+	clientKey = flags.String("client-key", "", `Private key (PEM) for --client-cert.`)
+
+	caBundle = flags.String("ca-bundle", "", `CA bundle (PEM) used to verify the DomeOS server instead of the system roots.`)
+
+	signingSecretFile = flags.String("signing-secret-file", "", `File holding a shared secret; if set, every delivery is signed with HMAC-SHA256 in the X-Signature header over "<X-Signature-Timestamp>.<body>".`)
+
+	tlsReloadInterval = flags.Duration("tls-reload-interval", time.Minute, `How often the client certificate, key and CA bundle are checked for rotation.`)
+
+	annotationSuppression = flags.Bool("annotation-suppression", false, `If true, honor the kube-event-watcher.io/suppress-reasons annotation (comma separated reasons, or "*") on namespaces and workloads.`)
+
+	filterConfigMap = flags.String("filter-configmap", "", `ConfigMap (namespace/name) persisting the filter rules managed through /admin/filters. If empty, rules only live in memory.`)
+
+	adminAddress = flags.String("admin-address", "127.0.0.1:8081", `Address the /admin endpoints listen on, apart from the metrics port. Empty disables them.`)
+
+	adminToken = flags.String("admin-token", "", `Bearer token required by the /admin endpoints. Required unless --admin-address is a loopback address.`)
+
+	cacheMaxAnnotationBytes = flags.Int("cache-max-annotation-bytes", 1024, `Annotations larger than this are dropped from the enrichment informer caches to save memory; -1 keeps all.`)
+
+	cloudMetadataEnabled = flags.Bool("cloud-metadata", false, `If true, add the cloud provider, region and account/project, discovered from node provider IDs, to every payload.`)
+
+	cloudMetadataIMDS = flags.Bool("cloud-metadata-imds", false, `If true, complete the cloud metadata from the instance metadata service (AWS, GCP, Azure).`)
+
+	cloudProvider = flags.String("cloud-provider", "", `Cloud provider to report, overriding discovery.`)
+
+	cloudRegion = flags.String("cloud-region", "", `Cloud region to report, overriding discovery.`)
+
+	cloudZone = flags.String("cloud-zone", "", `Cloud zone to report, overriding discovery.`)
+
+	cloudAccount = flags.String("cloud-account", "", `Cloud account/project/subscription to report, overriding discovery.`)
+
+	incidents = flags.Bool("incidents", false, `If true, report incidents (open/update/resolved per involved object and reason) instead of raw events.`)
+
+	incidentQuietPeriod = flags.Duration("incident-quiet-period", 10*time.Minute, `An incident is resolved after this long without a repeated Warning event.`)
+
+	incidentUpdateInterval = flags.Duration("incident-update-interval", 5*time.Minute, `Minimum interval between update notifications for the same open incident.`)
+
+	incidentResolveReasons = flags.StringSlice("incident-resolve-reasons", []string{"NodeNotReady=NodeReady", "FailedScheduling=Scheduled", "FailedMount=SuccessfulMountVolume", "FailedAttachVolume=SuccessfulAttachVolume"}, `Comma-separated <Warning reason>=<Normal reason> pairs: a Normal event with the reason on the right resolves the incident of the reason on the left on the same object. Other incidents are resolved by the quiet period only.`)
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mock-server" {
+		runMockServer(os.Args[2:])
+		return
+	}
+
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s mock-server [flags]  run a mock DomeOS receiver\n", os.Args[0])
 		flags.PrintDefaults()
 	}
 
 	err := flags.Parse(os.Args)
 	if err != nil {
-		log.Fatal("Error: %v", err)
+		log.Fatalf("Error: %v", err)
 	}
 
 	if *help {
@@ -79,9 +166,9 @@ func main() {
 	if *apiserver == "" && !(*inCluster) {
 		log.Fatal("--apiserver not set and --in-cluster is false; apiserver must be set to a valid URL")
 	}
-	log.Println("apiServer set to: %v", *apiserver)
+	log.Printf("apiServer set to: %v", *apiserver)
 
-	log.Println("token set to: %v", *token)
+	log.Printf("token set to: %v", *token)
 
 	proc.StartReaper()
 
@@ -90,8 +177,51 @@ func main() {
 		log.Fatal("Failed to create client: ", err)
 	}
 
-	initializeMetricCollection(kubeClient)
-	metricsServer()
+	encoder, err := newPayloadEncoder(*payloadTemplate, *fieldMappingFile)
+	if err != nil {
+		log.Fatal("Failed to configure payload encoding: ", err)
+	}
+	client, err := newDeliveryClient(*domeosServer, *clientCert, *clientKey, *caBundle, *tlsReloadInterval)
+	if err != nil {
+		log.Fatal("Failed to configure TLS: ", err)
+	}
+	if *cloudMetadataEnabled {
+		cloudMetadata = discoverCloudMetadata(kubeClient, *cloudMetadataIMDS, CloudMetadata{
+			Provider: *cloudProvider,
+			Region:   *cloudRegion,
+			Zone:     *cloudZone,
+			Account:  *cloudAccount,
+		})
+	}
+
+	d := newDeliverer(*domeosServer, client, encoder)
+	if d.signer, err = newPayloadSigner(*signingSecretFile); err != nil {
+		log.Fatal("Failed to read signing secret: ", err)
+	}
+	if *offlineBufferDir != "" {
+		if d.spool, err = openSpool(*offlineBufferDir, *offlineBufferMaxBytes); err != nil {
+			log.Fatal("Failed to open offline buffer: ", err)
+		}
+		go d.flushSpool(*offlineRetryInterval, *offlineFlushRate)
+	}
+	registerCollector(d.queueLengths)
+	d.run(*workers)
+
+	rules, err := newRuleFilter(kubeClient, *filterConfigMap)
+	if err != nil {
+		log.Fatal("Failed to load filter rules: ", err)
+	}
+	if *adminAddress != "" {
+		if err := serveAdmin(*adminAddress, rules, *adminToken); err != nil {
+			log.Fatal("Failed to start admin server: ", err)
+		}
+	}
+
+	synced := initializeMetricCollection(kubeClient, d, rules)
+	if *pushGateway != "" {
+		go pushMetrics(*pushGateway, *pushJob, *pushInterval)
+	}
+	metricsServer(synced)
 }
 
 func createKubeClient() (kubeClient clientset.Interface, err error) {
@@ -110,8 +240,8 @@ func createKubeClient() (kubeClient clientset.Interface, err error) {
 		if len(config.BearerToken) > 0 {
 			tokenPresent = true
 		}
-		log.Println("service account token present: %v", tokenPresent)
-		log.Println("service host: %s", config.Host)
+		log.Printf("service account token present: %v", tokenPresent)
+		log.Printf("service host: %s", config.Host)
 		if kubeClient, err = clientset.NewForConfig(config); err != nil {
 			return nil, err
 		}
@@ -153,10 +283,22 @@ func createKubeClient() (kubeClient clientset.Interface, err error) {
 	return kubeClient, nil
 }
 
-func metricsServer() {
+func metricsServer(synced cache.InformerSynced) {
 	// Address to listen on for web interface and telemetry
 	listenAddress := fmt.Sprintf(":%d", *port)
-	log.Println("Starting metrics server: %s", listenAddress)
+	log.Printf("Starting metrics server: %s", listenAddress)
+	http.HandleFunc("/metrics", metricsHandler)
+	// Not ready until the filter and event caches have synced, i.e. we are
+	// watching and filtering.
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !synced() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("informer cache not synced"))
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
+	})
 	// Add healthzPath
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -166,51 +308,97 @@ func metricsServer() {
 }
 
 type eventController struct {
+	deliverer *deliverer
+
+	// scope restricts forwarding to events of this node in node-local mode.
+	scope *nodeScope
+
+	// incidents, when set, replaces the raw event feed with incident
+	// open/update/resolved notifications.
+	incidents *incidentTracker
+
+	// filters run before delivery; any of them can drop an event.
+	filters []eventFilter
+
+	// synced is set to 1, atomically, once the initial list of events has
+	// been processed; updates and deletes are ignored until then. It is a
+	// flag rather than the informers' HasSynced because that takes the
+	// DeltaFIFO lock, which is held while the handlers run.
+	synced int32
 }
 
-func (*eventController) addEvent(obj interface{}) {
+func (ec *eventController) hasSynced() bool {
+	return atomic.LoadInt32(&ec.synced) == 1
+}
+
+func (ec *eventController) addEvent(obj interface{}) {
 	if obj != nil {
 		event,ok := obj.(*v1.Event)
 		if (!ok) {
 			return;
 		}
-		reportEvent(*domeosServer, DomeosEvent{
-			K8sEvent:   *event,
-			ClusterId:  *clusterId,
-			ClusterApi: *apiserver,
-			Type:       "add",
-		})
+		ec.report(event, "add")
 	}
 }
 
-func (*eventController) updateEvent(old, cur interface{}) {
+func (ec *eventController) updateEvent(old, cur interface{}) {
 	if cur != nil {
 		event ,ok:= cur.(*v1.Event)
 		if (!ok) {
 			return;
 		}
-		reportEvent(*domeosServer, DomeosEvent{
-			K8sEvent:   *event,
-			ClusterId:  *clusterId,
-			ClusterApi: *apiserver,
-			Type:       "update",
-		})
+		if !ec.hasSynced() {
+			return
+		}
+		// Periodic resyncs replay unchanged events as updates.
+		if prev, ok := old.(*v1.Event); ok && prev.ResourceVersion == event.ResourceVersion {
+			return
+		}
+		ec.report(event, "update")
 	}
 }
 
-func (*eventController) deleteEvent(obj interface{}) {
+func (ec *eventController) deleteEvent(obj interface{}) {
 	if obj != nil {
 		event, ok := obj.(*v1.Event)
 		if (!ok) {
 			return;
 		}
-		reportEvent(*domeosServer, DomeosEvent{
-			K8sEvent:   *event,
-			ClusterId:  *clusterId,
-			ClusterApi: *apiserver,
-			Type:       "delete",
-		})
+		if !ec.hasSynced() {
+			return
+		}
+		ec.report(event, "delete")
+	}
+}
+
+// report hands an event to the delivery workers unless it belongs to
+// another watcher instance or is dropped by the filter stage.
+func (ec *eventController) report(event *v1.Event, eventType string) {
+	if ec.scope != nil && !ec.scope.owns(event) {
+		return
+	}
+	if eventType != "delete" {
+		eventsTotal.inc(event.Namespace, event.Reason, event.Type)
+	}
+	if !runFilters(ec.filters, event) {
+		return
+	}
+	if ec.incidents != nil {
+		if eventType != "delete" {
+			// Events of the initial list only seed the tracker. The synced
+			// flag, unlike the informer's HasSynced, stays false until the
+			// last listed event has been handled.
+			ec.incidents.observe(event, !ec.hasSynced())
+		}
+		return
 	}
+	ec.deliverer.enqueue(DomeosEvent{
+		K8sEvent:   *event,
+		ClusterId:  *clusterId,
+		ClusterApi: *apiserver,
+		Type:       eventType,
+		Cloud:      cloudMetadata,
+	})
 }
 
 type DomeosEvent struct {
@@ -221,49 +409,105 @@ type DomeosEvent struct {
 	ClusterApi string `json:"clusterApi"`
 
 	Type string `json:"eventType"`
+
+	Incident *Incident `json:"incident,omitempty"`
+
+	Cloud *CloudMetadata `json:"cloud,omitempty"`
 }
 
-func reportEvent(url string, de DomeosEvent) {
-	eventstr, err := json.Marshal(de)
-	if err != nil {
-		log.Println("marshal DomeosEvent error: ", err)
-		return
+// initializeMetricCollection creates and starts informers and initializes and
+// registers metrics for collection. The returned function reports whether
+// the filter caches and event informers have completed their initial sync;
+// it does not block, so it is safe to call from probes and handlers.
+func initializeMetricCollection(kubeClient clientset.Interface, d *deliverer, rules *ruleFilter) cache.InformerSynced {
+	cclient := kubeClient.CoreV1().RESTClient()
+	ec := &eventController{deliverer: d}
+	if *nodeLocal && *nodeLocalRemainder {
+		log.Fatal("--node-local and --node-local-remainder are mutually exclusive")
 	}
-	// log.Println("report: %v", string(eventstr))
-	request, err := http.NewRequest("POST", url, bytes.NewReader(eventstr))
-	if err != nil {
-		log.Println("create request error: %v", err)
-		return
+	if *nodeLocal {
+		if *nodeName == "" {
+			log.Fatal("--node-local requires --node-name or the NODE_NAME environment variable")
+		}
+		ec.scope = newNodeScope(*nodeName)
 	}
-	request.Header.Set("Content-Type", "application/json;charset=UTF-8")
-
-	// var resp *http.Response
-	resp, err := http.DefaultClient.Do(request)
-	if err != nil {
-		log.Println("get response error, %v", err)
-	} else {
-		_, err := ioutil.ReadAll(resp.Body)
+	filterSynced := []cache.InformerSynced{rules.hasSynced}
+	ec.filters = append(ec.filters, rules)
+	if *annotationSuppression {
+		af := newAnnotationFilter(kubeClient)
+		ec.filters = append(ec.filters, af)
+		filterSynced = append(filterSynced, af.hasSynced)
+	}
+	if *incidents {
+		tracker, err := newIncidentTracker(d.enqueue, *incidentQuietPeriod, *incidentUpdateInterval, *incidentResolveReasons)
 		if err != nil {
-			log.Println("http.Do failed,[err=%s][url=%s]", err, url)
+			log.Fatal("Failed to configure incidents: ", err)
 		}
-		defer resp.Body.Close()
+		ec.incidents = tracker
 	}
+	var lws []cache.ListerWatcher
+	for _, selector := range eventSelectors() {
+		lws = append(lws, cache.NewListWatchFromClient(cclient, "events", v1.NamespaceAll, selector))
+	}
+	ec.watch(lws, filterSynced)
+	return ec.hasSynced
 }
 
-// initializeMetricCollection creates and starts informers and initializes and
-// registers metrics for collection.
-func initializeMetricCollection(kubeClient clientset.Interface) {
-	cclient := kubeClient.CoreV1().RESTClient()
-	elw := cache.NewListWatchFromClient(cclient, "events", v1.NamespaceAll, fields.Everything())
-	ec := &eventController{}
-	_, einf := cache.NewInformer(
-		elw,
-		&v1.Event{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc:    ec.addEvent,
-			DeleteFunc: ec.deleteEvent,
-		})
+// watch runs one event informer per ListerWatcher once the filter caches
+// have synced, and marks the controller synced once every informer has.
+func (ec *eventController) watch(lws []cache.ListerWatcher, filterSynced []cache.InformerSynced) {
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc:    ec.addEvent,
+		DeleteFunc: ec.deleteEvent,
+	}
+	if ec.incidents != nil {
+		handlers.UpdateFunc = ec.updateEvent
+	}
+	var informers []cache.Controller
+	var synced []cache.InformerSynced
+	for _, lw := range lws {
+		_, einf := cache.NewInformer(
+			lw,
+			&v1.Event{},
+			resyncPeriod,
+			handlers)
+		informers = append(informers, einf)
+		synced = append(synced, einf.HasSynced)
+	}
 
-	go einf.Run(wait.NeverStop)
+	go func() {
+		informerSynced.set(0, "filters")
+		informerSynced.set(0, "events")
+		// Events are watched only once the filter caches are complete, so
+		// the initial list is not forwarded unfiltered. This runs in the
+		// background: the metrics server, and with it the liveness probe,
+		// must not wait for large caches to load.
+		if !cache.WaitForCacheSync(wait.NeverStop, filterSynced...) {
+			return
+		}
+		log.Println("filter caches synced")
+		informerSynced.set(1, "filters")
+		for _, einf := range informers {
+			go einf.Run(wait.NeverStop)
+		}
+		// HasSynced waits for the handler of the last listed event to
+		// return, so every event seen after this is a live one.
+		if cache.WaitForCacheSync(wait.NeverStop, synced...) {
+			log.Println("event informers synced")
+			informerSynced.set(1, "events")
+			atomic.StoreInt32(&ec.synced, 1)
+		}
+	}()
+}
+
+// allSynced combines several InformerSynced funcs into one.
+func allSynced(synced ...cache.InformerSynced) cache.InformerSynced {
+	return func() bool {
+		for _, s := range synced {
+			if !s() {
+				return false
+			}
+		}
+		return true
+	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeEventWatch lists events and then serves the returned fake watch.
+func fakeEventWatch(events ...v1.Event) (cache.ListerWatcher, *watch.FakeWatcher) {
+	fw := watch.NewFake()
+	return &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &v1.EventList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: events}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return fw, nil
+		},
+	}, fw
+}
+
+func testEvent(name, typ, reason string, last time.Time) v1.Event {
+	return v1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-" + name), ResourceVersion: "1"},
+		InvolvedObject: v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-0"},
+		Type:           typ,
+		Reason:         reason,
+		FirstTimestamp: metav1.NewTime(last),
+		LastTimestamp:  metav1.NewTime(last),
+	}
+}
+
+func waitSynced(t *testing.T, ec *eventController) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ec.hasSynced() {
+		if time.Now().After(deadline) {
+			t.Fatal("event controller did not sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func nextDelivery(t *testing.T, d *deliverer) DomeosEvent {
+	select {
+	case de := <-d.queue:
+		return de
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was enqueued")
+	}
+	return DomeosEvent{}
+}
+
+func TestWatchDeliversDeleteAfterSync(t *testing.T) {
+	listed := testEvent("listed", "Normal", "Pulled", time.Now())
+	lw, fw := fakeEventWatch(listed)
+	d := &deliverer{queue: make(chan DomeosEvent, 10), critical: make(chan DomeosEvent, 10)}
+	ec := &eventController{deliverer: d}
+	ec.watch([]cache.ListerWatcher{lw}, nil)
+
+	if de := nextDelivery(t, d); de.Type != "add" || de.K8sEvent.Name != "listed" {
+		t.Fatalf("got %s of %s, want add of listed", de.Type, de.K8sEvent.Name)
+	}
+	waitSynced(t, ec)
+
+	// Events expire through their TTL; a delete must not wedge the informer.
+	fw.Delete(&listed)
+	if de := nextDelivery(t, d); de.Type != "delete" || de.K8sEvent.Name != "listed" {
+		t.Fatalf("got %s of %s, want delete of listed", de.Type, de.K8sEvent.Name)
+	}
+	added := testEvent("added", "Normal", "Started", time.Now())
+	fw.Add(&added)
+	if de := nextDelivery(t, d); de.Type != "add" || de.K8sEvent.Name != "added" {
+		t.Fatalf("got %s of %s, want add of added", de.Type, de.K8sEvent.Name)
+	}
+
+	ready := make(chan bool)
+	go func() { ready <- ec.hasSynced() }()
+	select {
+	case ok := <-ready:
+		if !ok {
+			t.Error("not ready after sync")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("readiness check blocked")
+	}
+}
+
+func TestWatchSeedsIncidentsFromInitialList(t *testing.T) {
+	// The last listed event is the one HasSynced already reports as synced.
+	listed := testEvent("listed", "Warning", "BackOff", time.Now().Add(-time.Minute))
+	lw, fw := fakeEventWatch(testEvent("older", "Normal", "Pulled", time.Now().Add(-2*time.Minute)), listed)
+	d := &deliverer{queue: make(chan DomeosEvent, 10), critical: make(chan DomeosEvent, 10)}
+	ec := &eventController{deliverer: d}
+	tracker, err := newIncidentTracker(d.enqueue, 10*time.Minute, 5*time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec.incidents = tracker
+	ec.watch([]cache.ListerWatcher{lw}, nil)
+	waitSynced(t, ec)
+
+	live := testEvent("live", "Warning", "FailedMount", time.Now())
+	fw.Add(&live)
+	de := nextDelivery(t, d)
+	if de.Incident == nil || de.Incident.Reason != "FailedMount" || de.Incident.State != incidentOpen {
+		t.Fatalf("first notification = %+v, want FailedMount opening; the replayed BackOff must not notify", de.Incident)
+	}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if len(tracker.open["Pod/default/web-0"]) != 2 {
+		t.Errorf("replayed BackOff was not seeded")
+	}
+}
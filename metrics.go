@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a minimal Prometheus counter or gauge with labels, rendered in
+// the text exposition format. It is enough for the handful of series the
+// watcher exports without pulling a client library into the vendor tree.
+type metric struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+var (
+	metricsMu         sync.Mutex
+	registeredMetrics []*metric
+	// collectors refresh gauges that are computed on demand at scrape time.
+	collectors []func()
+
+	eventsTotal = newCounter("kube_event_watcher_events_total",
+		"Number of Kubernetes events observed by the watcher.", "namespace", "reason", "type")
+
+	queueLength = newGauge("kube_event_watcher_queue_length",
+		"Number of events waiting for a delivery worker.", "queue")
+
+	informerSynced = newGauge("kube_event_watcher_informer_synced",
+		"Whether the informer has completed its initial sync (1) or not (0).", "informer")
+)
+
+func newCounter(name, help string, labels ...string) *metric {
+	return register(&metric{name: name, help: help, typ: "counter", labels: labels})
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return register(&metric{name: name, help: help, typ: "gauge", labels: labels})
+}
+
+func register(m *metric) *metric {
+	m.values = map[string]*sample{}
+	metricsMu.Lock()
+	registeredMetrics = append(registeredMetrics, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.sample(labelValues).value += v
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.sample(labelValues).value = v
+	m.mu.Unlock()
+}
+
+// sample must be called with m.mu held.
+func (m *metric) sample(labelValues []string) *sample {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		m.values[key] = s
+	}
+	return s
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.values[k]
+		fmt.Fprint(w, m.name)
+		if len(m.labels) > 0 {
+			pairs := make([]string, len(m.labels))
+			for i, l := range m.labels {
+				var v string
+				if i < len(s.labelValues) {
+					v = s.labelValues[i]
+				}
+				pairs[i] = fmt.Sprintf(`%s="%s"`, l, escapeLabelValue(v))
+			}
+			fmt.Fprintf(w, "{%s}", strings.Join(pairs, ","))
+		}
+		fmt.Fprintf(w, " %s\n", strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func registerCollector(collect func()) {
+	metricsMu.Lock()
+	collectors = append(collectors, collect)
+	metricsMu.Unlock()
+}
+
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	ms := append([]*metric(nil), registeredMetrics...)
+	cs := append([]func(){}, collectors...)
+	metricsMu.Unlock()
+	for _, collect := range cs {
+		collect()
+	}
+	for _, m := range ms {
+		m.write(w)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// pushMetrics periodically PUTs the current metrics to a Pushgateway, for
+// clusters where Prometheus cannot reach the watcher to scrape it.
+func pushMetrics(gateway, job string, interval time.Duration) {
+	target := fmt.Sprintf("%s/metrics/job/%s/cluster/%d",
+		strings.TrimRight(gateway, "/"), url.PathEscape(job), *clusterId)
+	log.Printf("pushing metrics to %s every %v", target, interval)
+	for range time.Tick(interval) {
+		var buf bytes.Buffer
+		writeMetrics(&buf)
+		request, err := http.NewRequest("PUT", target, &buf)
+		if err != nil {
+			log.Printf("create push request error: %v", err)
+			continue
+		}
+		request.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		resp, err := http.DefaultClient.Do(request)
+		if err != nil {
+			log.Printf("push metrics error, %v", err)
+			continue
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("push metrics to %s failed: %s", target, resp.Status)
+		}
+	}
+}
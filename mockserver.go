@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	flag "github.com/spf13/pflag"
+)
+
+// runMockServer implements the "mock-server" subcommand: a stand-in for the
+// DomeOS receiver that prints and validates incoming payloads and can
+// inject faults, for exercising retry, throttling and signing end to end.
+func runMockServer(args []string) {
+	fs := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	listen := fs.String("listen", ":8089", `Address to listen on.`)
+	path := fs.String("path", "/api/k8sevent/report", `Path events are posted to.`)
+	validate := fs.Bool("validate", true, `Reject payloads that are not a DomeosEvent with 400.`)
+	quiet := fs.Bool("quiet", false, `Only print a one-line summary per request instead of the payload.`)
+	delay := fs.Duration("delay", 0, `Delay before answering each request.`)
+	errorRate := fs.Float64("error-rate", 0, `Fraction of requests (0-1) answered with 500.`)
+	throttleRate := fs.Float64("throttle-rate", 0, `Fraction of requests (0-1) answered with 429.`)
+	unavailableRate := fs.Float64("unavailable-rate", 0, `Fraction of requests (0-1) answered with 503.`)
+	retryAfter := fs.Duration("retry-after", 5*time.Second, `Retry-After sent with 429/503 answers; 0 omits the header.`)
+	secretFile := fs.String("signing-secret-file", "", `If set, require a valid X-Signature made with this shared secret.`)
+	maxSkew := fs.Duration("max-skew", 5*time.Minute, `Maximum age of X-Signature-Timestamp accepted when verifying signatures.`)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s mock-server:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	signer, err := newPayloadSigner(*secretFile)
+	if err != nil {
+		log.Fatal("Failed to read signing secret: ", err)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	var count int64
+	http.HandleFunc(*path, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&count, 1)
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if *delay > 0 {
+			time.Sleep(*delay)
+		}
+
+		if signer != nil {
+			if err := verifySignature(signer, r, body, *maxSkew); err != nil {
+				log.Printf("#%d rejected: %v", n, err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		roll := rand.Float64()
+		switch {
+		case roll < *errorRate:
+			log.Printf("#%d injected 500", n)
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+			return
+		case roll < *errorRate+*throttleRate:
+			log.Printf("#%d injected 429", n)
+			throttle(w, http.StatusTooManyRequests, *retryAfter)
+			return
+		case roll < *errorRate+*throttleRate+*unavailableRate:
+			log.Printf("#%d injected 503", n)
+			throttle(w, http.StatusServiceUnavailable, *retryAfter)
+			return
+		}
+
+		summary := fmt.Sprintf("%d bytes", len(body))
+		if *validate {
+			var de DomeosEvent
+			if err := json.Unmarshal(body, &de); err != nil {
+				log.Printf("#%d invalid payload: %v", n, err)
+				http.Error(w, "invalid DomeosEvent: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if de.Type == "" || de.K8sEvent.Name == "" {
+				log.Printf("#%d invalid payload: missing eventType or k8sEvent.metadata.name", n)
+				http.Error(w, "invalid DomeosEvent: missing eventType or k8sEvent.metadata.name", http.StatusBadRequest)
+				return
+			}
+			summary = fmt.Sprintf("%s cluster=%d %s/%s %s %s", de.Type, de.ClusterId,
+				de.K8sEvent.Namespace, de.K8sEvent.InvolvedObject.Name, de.K8sEvent.Type, de.K8sEvent.Reason)
+		}
+		if *quiet {
+			log.Printf("#%d %s", n, summary)
+		} else {
+			log.Printf("#%d %s\n%s", n, summary, body)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	log.Printf("mock DomeOS receiver listening on %s%s", *listen, *path)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+func throttle(w http.ResponseWriter, status int, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+func verifySignature(signer *payloadSigner, r *http.Request, body []byte, maxSkew time.Duration) error {
+	timestamp, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid %s", timestampHeader)
+	}
+	sent := time.Unix(timestamp, 0)
+	if skew := time.Since(sent); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("stale %s (%v)", timestampHeader, skew)
+	}
+	expected := &http.Request{Header: http.Header{}}
+	signer.sign(expected, body, sent)
+	if !hmac.Equal([]byte(r.Header.Get(signatureHeader)), []byte(expected.Header.Get(signatureHeader))) {
+		return fmt.Errorf("bad %s", signatureHeader)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// kubeletComponent is the event source component of kubelet events.
+const kubeletComponent = "kubelet"
+
+// Node-local mode splits the event stream by source between a DaemonSet and
+// a single "remainder" instance:
+//
+//   - the instance on node N forwards the events its kubelet reports;
+//   - the remainder instance forwards every event not reported by a
+//     kubelet, including those about Nodes, such as the node controller's
+//     NodeNotReady.
+//
+// Events about a node that fails, or that runs no DaemonSet pod, thus still
+// reach the remainder instance. The kubelet events of a node without a
+// DaemonSet pod are not forwarded, so the DaemonSet should tolerate the
+// taints of every node whose kubelet events matter. The apiserver
+// cannot field-select by source host, so a node-local instance receives
+// the kubelet events of every node and drops the foreign ones.
+
+// nodeScope drops the kubelet events of other nodes in node-local mode.
+type nodeScope struct {
+	nodeName string
+}
+
+func newNodeScope(nodeName string) *nodeScope {
+	log.Printf("node-local mode: forwarding events of node %s", nodeName)
+	return &nodeScope{nodeName: nodeName}
+}
+
+func (n *nodeScope) owns(event *v1.Event) bool {
+	return event.Source.Host == n.nodeName
+}
+
+// eventSelectors returns the field selectors of the event watches for the
+// configured mode; each selector gets its own informer.
+func eventSelectors() []fields.Selector {
+	switch {
+	case *nodeLocal:
+		return []fields.Selector{fields.OneTermEqualSelector("source", kubeletComponent)}
+	case *nodeLocalRemainder:
+		return []fields.Selector{fields.OneTermNotEqualSelector("source", kubeletComponent)}
+	}
+	return []fields.Selector{fields.Everything()}
+}
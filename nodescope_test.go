@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestNodeScopeOwnsOnlyLocalKubeletEvents(t *testing.T) {
+	n := newNodeScope("node-a")
+	tests := []struct {
+		event v1.Event
+		want  bool
+	}{
+		{v1.Event{Source: v1.EventSource{Component: "kubelet", Host: "node-a"}, InvolvedObject: v1.ObjectReference{Kind: "Pod"}}, true},
+		{v1.Event{Source: v1.EventSource{Component: "kubelet", Host: "node-a"}, InvolvedObject: v1.ObjectReference{Kind: "Node", Name: "node-a"}}, true},
+		{v1.Event{Source: v1.EventSource{Component: "kubelet", Host: "node-b"}, InvolvedObject: v1.ObjectReference{Kind: "Pod"}}, false},
+		// Node controller events belong to the remainder instance.
+		{v1.Event{Source: v1.EventSource{Component: "node-controller"}, InvolvedObject: v1.ObjectReference{Kind: "Node", Name: "node-a"}}, false},
+	}
+	for _, tt := range tests {
+		if got := n.owns(&tt.event); got != tt.want {
+			t.Errorf("owns(%s from %s/%s about %s) = %v, want %v", tt.event.Reason, tt.event.Source.Component, tt.event.Source.Host, tt.event.InvolvedObject.Kind, got, tt.want)
+		}
+	}
+}
+
+func TestEventSelectorsPartitionBySource(t *testing.T) {
+	defer func(local, remainder bool) { *nodeLocal, *nodeLocalRemainder = local, remainder }(*nodeLocal, *nodeLocalRemainder)
+
+	*nodeLocal, *nodeLocalRemainder = true, false
+	local := eventSelectors()
+	*nodeLocal, *nodeLocalRemainder = false, true
+	remainder := eventSelectors()
+	if len(local) != 1 || local[0].String() != "source=kubelet" {
+		t.Errorf("node-local selectors = %v, want [source=kubelet]", local)
+	}
+	if len(remainder) != 1 || remainder[0].String() != "source!=kubelet" {
+		t.Errorf("remainder selectors = %v, want [source!=kubelet]", remainder)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"text/template"
+)
+
+// payloadEncoder turns a DomeosEvent into the request body sent to the
+// receiver: the JSON form by default (optionally reshaped by a field
+// mapping), or the output of a user supplied template.
+type payloadEncoder struct {
+	template *template.Template
+	mapping  *fieldMapping
+}
+
+func newPayloadEncoder(templatePath, mappingPath string) (*payloadEncoder, error) {
+	e := &payloadEncoder{}
+	if mappingPath != "" {
+		m, err := loadFieldMapping(mappingPath)
+		if err != nil {
+			return nil, err
+		}
+		e.mapping = m
+	}
+	if templatePath == "" {
+		return e, nil
+	}
+	text, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	if e.template, err = parsePayloadTemplate(templatePath, string(text)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *payloadEncoder) encode(de DomeosEvent) ([]byte, error) {
+	if e.template == nil {
+		if e.mapping != nil {
+			return e.mapping.apply(de)
+		}
+		return json.Marshal(de)
+	}
+	var buf bytes.Buffer
+	if err := e.template.Execute(&buf, de); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// filterRulesKey is the ConfigMap data key holding the JSON encoded rules.
+const filterRulesKey = "filters.json"
+
+// filterRule matches events on the listed fields; empty fields match
+// anything. Matching events are dropped, or rate limited when RateLimit is
+// set. A rule without any field set matches every event and must say so
+// with All.
+type filterRule struct {
+	ID string `json:"id"`
+
+	Namespace string `json:"namespace,omitempty"`
+
+	Kind string `json:"kind,omitempty"`
+
+	Name string `json:"name,omitempty"`
+
+	Reason string `json:"reason,omitempty"`
+
+	Type string `json:"type,omitempty"`
+
+	All bool `json:"all,omitempty"`
+
+	RateLimit *ruleRateLimit `json:"rateLimit,omitempty"`
+
+	// ExpiresAt lets a mute lapse on its own once an incident is over.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// ruleRateLimit forwards at most Events matching events per Per, with
+// bursts of up to Events.
+type ruleRateLimit struct {
+	Events int `json:"events"`
+
+	Per metav1.Duration `json:"per"`
+}
+
+func (r *filterRule) validate() error {
+	if !r.All && r.Namespace == "" && r.Kind == "" && r.Name == "" && r.Reason == "" && r.Type == "" {
+		return fmt.Errorf(`rule has no matchers; set "all": true to match every event`)
+	}
+	if r.RateLimit != nil && (r.RateLimit.Events <= 0 || r.RateLimit.Per.Duration <= 0) {
+		return fmt.Errorf("rateLimit needs positive events and per")
+	}
+	return nil
+}
+
+func (r *filterRule) matches(event *v1.Event) bool {
+	ref := event.InvolvedObject
+	return (r.Namespace == "" || r.Namespace == event.Namespace) &&
+		(r.Kind == "" || r.Kind == ref.Kind) &&
+		(r.Name == "" || r.Name == ref.Name) &&
+		(r.Reason == "" || r.Reason == event.Reason) &&
+		(r.Type == "" || r.Type == event.Type)
+}
+
+type activeRule struct {
+	filterRule
+	limiter *rate.Limiter
+}
+
+// errRulesNotLoaded is returned for edits before the ConfigMap has synced.
+var errRulesNotLoaded = fmt.Errorf("filter rules are not loaded yet")
+
+// invalidRuleError rejects an edit because of the rule itself, as opposed
+// to a failure to persist it.
+type invalidRuleError struct {
+	err error
+}
+
+func (e invalidRuleError) Error() string {
+	return "invalid rule: " + e.err.Error()
+}
+
+// ruleExistsError rejects adding a rule whose ID is taken.
+type ruleExistsError string
+
+func (e ruleExistsError) Error() string {
+	return fmt.Sprintf("rule %q already exists", string(e))
+}
+
+// ruleFilter is the runtime-tunable part of the filter stage. Rules are
+// managed through the admin API and, when a ConfigMap is configured,
+// persisted to it and reloaded from it so every replica shares them.
+type ruleFilter struct {
+	kubeClient        clientset.Interface
+	namespace, cmName string
+
+	// editMu serializes admin edits, which read, modify and persist the
+	// whole rule set.
+	editMu sync.Mutex
+
+	// hasSynced reports whether the ConfigMap has been loaded. Edits are
+	// refused until then, as they would overwrite the persisted rules.
+	hasSynced cache.InformerSynced
+
+	mu    sync.RWMutex
+	rules []*activeRule
+}
+
+// newRuleFilter loads persisted rules from the ConfigMap "namespace/name"
+// and keeps following it. An empty configMap keeps rules in memory only.
+func newRuleFilter(kubeClient clientset.Interface, configMap string) (*ruleFilter, error) {
+	f := &ruleFilter{kubeClient: kubeClient, hasSynced: func() bool { return true }}
+	if configMap == "" {
+		return f, nil
+	}
+	parts := strings.SplitN(configMap, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("filter ConfigMap must be namespace/name, got %q", configMap)
+	}
+	f.namespace, f.cmName = parts[0], parts[1]
+
+	lw := cache.NewListWatchFromClient(kubeClient.CoreV1().RESTClient(), "configmaps", f.namespace,
+		fields.OneTermEqualSelector("metadata.name", f.cmName))
+	_, inf := cache.NewInformer(lw, &v1.ConfigMap{}, resyncPeriod, cache.ResourceEventHandlerFuncs{
+		AddFunc:    f.loadConfigMap,
+		UpdateFunc: func(old, cur interface{}) { f.loadConfigMap(cur) },
+	})
+	go inf.Run(wait.NeverStop)
+	f.hasSynced = inf.HasSynced
+	return f, nil
+}
+
+func (f *ruleFilter) name() string {
+	return "rule"
+}
+
+func (f *ruleFilter) allow(event *v1.Event) bool {
+	now := time.Now()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, r := range f.rules {
+		if r.ExpiresAt != nil && now.After(*r.ExpiresAt) {
+			continue
+		}
+		if !r.matches(event) {
+			continue
+		}
+		if r.limiter == nil || !r.limiter.Allow() {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *ruleFilter) list() []filterRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	rules := make([]filterRule, len(f.rules))
+	for i, r := range f.rules {
+		rules[i] = r.filterRule
+	}
+	return rules
+}
+
+func (f *ruleFilter) add(rule filterRule) (filterRule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, invalidRuleError{err}
+	}
+	if rule.ID == "" {
+		rule.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	f.editMu.Lock()
+	defer f.editMu.Unlock()
+	if !f.hasSynced() {
+		return rule, errRulesNotLoaded
+	}
+	rules := f.list()
+	for _, r := range rules {
+		if r.ID == rule.ID {
+			return rule, ruleExistsError(rule.ID)
+		}
+	}
+	return rule, f.replace(append(rules, rule), true)
+}
+
+// remove deletes the rule with the given id and reports whether it existed.
+func (f *ruleFilter) remove(id string) (bool, error) {
+	f.editMu.Lock()
+	defer f.editMu.Unlock()
+	if !f.hasSynced() {
+		return false, errRulesNotLoaded
+	}
+	rules := f.list()
+	for i, r := range rules {
+		if r.ID == id {
+			return true, f.replace(append(rules[:i], rules[i+1:]...), true)
+		}
+	}
+	return false, nil
+}
+
+// replace installs rules, keeping the limiter state of unchanged rules,
+// and optionally persists them.
+func (f *ruleFilter) replace(rules []filterRule, persist bool) error {
+	if persist && f.cmName != "" {
+		if err := f.saveConfigMap(rules); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	previous := map[string]*activeRule{}
+	for _, r := range f.rules {
+		previous[r.ID] = r
+	}
+	active := make([]*activeRule, 0, len(rules))
+	for _, r := range rules {
+		if p, ok := previous[r.ID]; ok && reflect.DeepEqual(p.filterRule, r) {
+			active = append(active, p)
+			continue
+		}
+		a := &activeRule{filterRule: r}
+		if r.RateLimit != nil {
+			every := r.RateLimit.Per.Duration / time.Duration(r.RateLimit.Events)
+			a.limiter = rate.NewLimiter(rate.Every(every), r.RateLimit.Events)
+		}
+		active = append(active, a)
+	}
+	f.rules = active
+	return nil
+}
+
+func (f *ruleFilter) loadConfigMap(obj interface{}) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		return
+	}
+	var rules []filterRule
+	if data := cm.Data[filterRulesKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &rules); err != nil {
+			log.Printf("ignoring filter ConfigMap %s/%s: %v", cm.Namespace, cm.Name, err)
+			return
+		}
+	}
+	// The ConfigMap may be edited by hand: an invalid rule could drop
+	// every event or crash the limiter, so it is skipped.
+	valid := rules[:0]
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			log.Printf("ignoring filter rule %q from ConfigMap %s/%s: %v", r.ID, cm.Namespace, cm.Name, err)
+			continue
+		}
+		valid = append(valid, r)
+	}
+	f.replace(valid, false)
+	log.Printf("loaded %d filter rules from ConfigMap %s/%s", len(valid), cm.Namespace, cm.Name)
+}
+
+func (f *ruleFilter) saveConfigMap(rules []filterRule) error {
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	configMaps := f.kubeClient.CoreV1().ConfigMaps(f.namespace)
+	cm, err := configMaps.Get(f.cmName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: f.namespace, Name: f.cmName},
+			Data:       map[string]string{filterRulesKey: string(data)},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[filterRulesKey] = string(data)
+	_, err = configMaps.Update(cm)
+	return err
+}
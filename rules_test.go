@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadConfigMapSkipsInvalidRules(t *testing.T) {
+	f := &ruleFilter{}
+	f.loadConfigMap(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "filters"},
+		Data: map[string]string{filterRulesKey: `[
+			{"id": "zero-rate", "reason": "BackOff", "rateLimit": {"events": 0, "per": "1m"}},
+			{"id": "no-matchers"},
+			{"id": "mute-pulled", "reason": "Pulled"},
+			{"id": "everything", "all": true, "rateLimit": {"events": 10, "per": "1s"}}
+		]`},
+	})
+
+	var ids []string
+	for _, r := range f.list() {
+		ids = append(ids, r.ID)
+	}
+	if len(ids) != 2 || ids[0] != "mute-pulled" || ids[1] != "everything" {
+		t.Fatalf("loaded rules %q, want [mute-pulled everything]", ids)
+	}
+	if f.allow(&v1.Event{Reason: "Pulled"}) {
+		t.Error("valid rule from the ConfigMap was not applied")
+	}
+	if !f.allow(&v1.Event{Reason: "BackOff"}) {
+		t.Error("event dropped although only invalid rules match it")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// spoolCompactBytes is how much delivered data the spool lets accumulate at
+// the head of its data file before copying the remainder to a fresh file.
+const spoolCompactBytes = 4 << 20
+
+var (
+	errSpoolFull = errors.New("buffer is full")
+
+	offlineBufferBytes = newGauge("kube_event_watcher_offline_buffer_bytes",
+		"Bytes of undelivered events held in the offline buffer.")
+)
+
+// spool is an on-disk FIFO of encoded payloads used while the receiver is
+// unreachable. Records are appended to a data file as a 4-byte big-endian
+// length followed by the payload. The offset file holds the generation of
+// the live data file and the read position in it, so a restart resumes
+// where flushing stopped.
+//
+// Delivered records are reclaimed by compaction: the undelivered tail is
+// copied to the data file of the next generation and the offset file is
+// switched to it in one rename, so a crash leaves either the old or the new
+// file in use. maxBytes bounds the data file itself, not just the
+// undelivered part of it.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	gen     int64
+	data    *os.File
+	size    int64
+	readOff int64
+}
+
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes}
+	if raw, err := ioutil.ReadFile(s.offsetPath()); err == nil {
+		if s.gen, s.readOff, err = parseOffset(string(raw)); err != nil {
+			return nil, fmt.Errorf("corrupt offset file %s", s.offsetPath())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err := os.OpenFile(s.dataPath(s.gen), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := data.Stat()
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	s.data, s.size = data, info.Size()
+	if s.readOff > s.size {
+		data.Close()
+		return nil, fmt.Errorf("offset %d is past the end of %s", s.readOff, s.dataPath(s.gen))
+	}
+	if err := s.recover(); err != nil {
+		data.Close()
+		return nil, err
+	}
+	s.removeStale()
+	offlineBufferBytes.set(float64(s.size - s.readOff))
+	return s, nil
+}
+
+func (s *spool) dataPath(gen int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("events-%d.spool", gen))
+}
+
+func (s *spool) offsetPath() string {
+	return filepath.Join(s.dir, "events.offset")
+}
+
+// parseOffset parses the "<generation> <offset>" content of the offset file.
+func parseOffset(raw string) (gen, off int64, err error) {
+	fields := strings.Fields(raw)
+	if len(fields) != 2 {
+		return 0, 0, errors.New("want two fields")
+	}
+	if gen, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if off, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if gen < 0 || off < 0 {
+		return 0, 0, errors.New("negative value")
+	}
+	return gen, off, nil
+}
+
+// recover walks the records after the read position and truncates a
+// partial record left at the end by a crash during append.
+func (s *spool) recover() error {
+	off := s.readOff
+	for off < s.size {
+		length, ok := s.recordLength(off)
+		if !ok {
+			log.Printf("offline buffer: dropping %d bytes of an incomplete record at offset %d", s.size-off, off)
+			if err := s.data.Truncate(off); err != nil {
+				return err
+			}
+			s.size = off
+			break
+		}
+		off += 4 + length
+	}
+	return nil
+}
+
+// recordLength returns the length of the payload of the record at off, and
+// false if the record does not fit in the data file. It must be called with
+// s.mu held or before the spool is shared.
+func (s *spool) recordLength(off int64) (int64, bool) {
+	var header [4]byte
+	if off+4 > s.size {
+		return 0, false
+	}
+	if _, err := s.data.ReadAt(header[:], off); err != nil {
+		return 0, false
+	}
+	length := int64(binary.BigEndian.Uint32(header[:]))
+	return length, off+4+length <= s.size
+}
+
+// removeStale deletes data files of other generations, left behind by a
+// crash during compaction.
+func (s *spool) removeStale() {
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "events-*.spool"))
+	for _, p := range paths {
+		if p != s.dataPath(s.gen) {
+			os.Remove(p)
+		}
+	}
+}
+
+func (s *spool) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readOff < s.size
+}
+
+func (s *spool) append(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int64(4 + len(body))
+	if s.maxBytes > 0 && s.size+n > s.maxBytes {
+		if s.readOff > 0 {
+			if err := s.compact(); err != nil {
+				return err
+			}
+		}
+		if s.size+n > s.maxBytes {
+			return errSpoolFull
+		}
+	}
+	record := make([]byte, n)
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	copy(record[4:], body)
+	if _, err := s.data.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	s.size += n
+	offlineBufferBytes.set(float64(s.size - s.readOff))
+	return nil
+}
+
+// peek returns the oldest undelivered payload without consuming it. A
+// record that does not fit in the data file means the file is corrupt past
+// the read position; the remainder is discarded so delivery can go on.
+func (s *spool) peek() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	length, ok := s.recordLength(s.readOff)
+	if !ok {
+		dropped := s.size - s.readOff
+		s.readOff = s.size
+		offlineBufferBytes.set(0)
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("corrupt record, discarded %d bytes", dropped)
+	}
+	body := make([]byte, length)
+	if _, err := s.data.ReadAt(body, s.readOff+4); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// commit consumes the payload last returned by peek.
+func (s *spool) commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	length, ok := s.recordLength(s.readOff)
+	if !ok {
+		return fmt.Errorf("no complete record at offset %d", s.readOff)
+	}
+	s.readOff += 4 + length
+	offlineBufferBytes.set(float64(s.size - s.readOff))
+	if s.readOff == s.size || (s.readOff >= spoolCompactBytes && s.readOff >= s.size-s.readOff) {
+		return s.compact()
+	}
+	return s.writeOffset(s.gen, s.readOff)
+}
+
+// compact copies the undelivered records to the data file of the next
+// generation and switches to it. It must be called with s.mu held.
+func (s *spool) compact() error {
+	next := s.gen + 1
+	out, err := os.OpenFile(s.dataPath(next), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.NewSectionReader(s.data, s.readOff, s.size-s.readOff))
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		// The commit point: from here on a restart uses the new file.
+		err = s.writeOffset(next, 0)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(s.dataPath(next))
+		return err
+	}
+	s.data.Close()
+	os.Remove(s.dataPath(s.gen))
+	s.gen, s.data, s.size, s.readOff = next, out, n, 0
+	return nil
+}
+
+// writeOffset must be called with s.mu held.
+func (s *spool) writeOffset(gen, off int64) error {
+	tmp := s.offsetPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", gen, off)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.offsetPath())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func mustAppend(t *testing.T, s *spool, bodies ...string) {
+	for _, b := range bodies {
+		if err := s.append([]byte(b)); err != nil {
+			t.Fatalf("append %q: %v", b, err)
+		}
+	}
+}
+
+// drain peeks and commits every pending record.
+func drain(t *testing.T, s *spool) []string {
+	var got []string
+	for s.pending() {
+		body, err := s.peek()
+		if err != nil {
+			t.Fatalf("peek: %v", err)
+		}
+		if err := s.commit(); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		got = append(got, string(body))
+	}
+	return got
+}
+
+func expectRecords(t *testing.T, got []string, want ...string) {
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("records = %q, want %q", got, want)
+	}
+}
+
+func TestSpoolFIFO(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.pending() {
+		t.Fatal("new spool is pending")
+	}
+	mustAppend(t, s, "one", "two")
+
+	// peek does not consume.
+	for i := 0; i < 2; i++ {
+		body, err := s.peek()
+		if err != nil || string(body) != "one" {
+			t.Fatalf("peek = %q, %v; want one", body, err)
+		}
+	}
+	mustAppend(t, s, "three")
+	expectRecords(t, drain(t, s), "one", "two", "three")
+	if s.size != 0 || s.readOff != 0 {
+		t.Errorf("drained spool has size %d, offset %d", s.size, s.readOff)
+	}
+}
+
+func TestSpoolResumesAfterRestart(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, "one", "two", "three")
+	if _, err := s.peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.commit(); err != nil {
+		t.Fatal(err)
+	}
+	s.data.Close()
+
+	s, err = openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRecords(t, drain(t, s), "two", "three")
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	// Room for two 6-byte records.
+	s, err := openSpool(dir, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, "aa", "bb")
+	if err := s.append([]byte("cc")); err != errSpoolFull {
+		t.Fatalf("append to a full spool = %v, want errSpoolFull", err)
+	}
+	// Committing one record makes room again, and the data file itself
+	// stays within the limit.
+	if _, err := s.peek(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.commit(); err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, "cc")
+	info, err := s.data.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 12 {
+		t.Errorf("data file is %d bytes, limit is 12", info.Size())
+	}
+	expectRecords(t, drain(t, s), "bb", "cc")
+}
+
+func TestSpoolFileStaysBoundedUnderLoad(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep a few records pending at all times so the spool never drains.
+	mustAppend(t, s, "0", "1", "2")
+	for i := 3; i < 1000; i++ {
+		mustAppend(t, s, fmt.Sprint(i))
+		if _, err := s.peek(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := s.data.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 1<<10 {
+		t.Errorf("data file grew to %d bytes, limit is %d", info.Size(), 1<<10)
+	}
+	expectRecords(t, drain(t, s), "997", "998", "999")
+	paths, _ := filepath.Glob(filepath.Join(dir, "events-*.spool"))
+	if len(paths) != 1 {
+		t.Errorf("data files = %v, want only the live one", paths)
+	}
+}
+
+func TestSpoolRecoversTruncatedRecord(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, "one", "two")
+	// A crash in the middle of appending a 100-byte record.
+	if _, err := s.data.WriteAt([]byte{0, 0, 0, 100, 'p', 'a', 'r'}, s.size); err != nil {
+		t.Fatal(err)
+	}
+	complete := s.size
+	s.data.Close()
+
+	s, err = openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.size != complete {
+		t.Errorf("size after recovery = %d, want %d", s.size, complete)
+	}
+	expectRecords(t, drain(t, s), "one", "two")
+
+	// New records go after the recovered ones.
+	mustAppend(t, s, "three")
+	expectRecords(t, drain(t, s), "three")
+}
+
+func TestSpoolPeekDiscardsCorruptRecord(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, "one")
+	// Claim a length far past the end of the file.
+	if _, err := s.data.WriteAt([]byte{0x7f, 0, 0, 0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.peek(); err == nil {
+		t.Fatal("peek of a corrupt record succeeded")
+	}
+	if s.pending() {
+		t.Fatal("spool still pending after discarding the corrupt record")
+	}
+	mustAppend(t, s, "two")
+	expectRecords(t, drain(t, s), "two")
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// templateFuncs is the function library available to payload templates.
+// Names and argument order follow sprig where an equivalent exists, so
+// templates written for other tools mostly carry over.
+var templateFuncs = template.FuncMap{
+	// time
+	"now":     time.Now,
+	"date":    formatDate,
+	"dateUTC": formatDateUTC,
+	"unix":    unixTime,
+	"ago":     ago,
+
+	// JSON
+	"toJson":   toJSON,
+	"jsonPath": jsonPath,
+	"quote":    quote,
+
+	// strings
+	"trunc":           trunc,
+	"upper":           strings.ToUpper,
+	"lower":           strings.ToLower,
+	"title":           strings.Title,
+	"trim":            strings.TrimSpace,
+	"replace":         replace,
+	"contains":        contains,
+	"hasPrefix":       hasPrefix,
+	"hasSuffix":       hasSuffix,
+	"splitList":       splitList,
+	"join":            join,
+	"indent":          indent,
+	"regexMatch":      regexMatch,
+	"regexFind":       regexFind,
+	"regexReplaceAll": regexReplaceAll,
+
+	// defaults
+	"default":  defaultValue,
+	"empty":    empty,
+	"coalesce": coalesce,
+	"ternary":  ternary,
+}
+
+func parsePayloadTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// toTime accepts the time representations found in events and templates:
+// time.Time, metav1.Time/MicroTime (and pointers to them), RFC 3339
+// strings and unix seconds.
+func toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case *time.Time:
+		if t == nil {
+			return time.Time{}, nil
+		}
+		return *t, nil
+	case metav1.Time:
+		return t.Time, nil
+	case *metav1.Time:
+		if t == nil {
+			return time.Time{}, nil
+		}
+		return t.Time, nil
+	case metav1.MicroTime:
+		return t.Time, nil
+	case *metav1.MicroTime:
+		if t == nil {
+			return time.Time{}, nil
+		}
+		return t.Time, nil
+	case string:
+		return time.Parse(time.RFC3339, t)
+	case int:
+		return time.Unix(int64(t), 0), nil
+	case int64:
+		return time.Unix(t, 0), nil
+	case float64:
+		return time.Unix(int64(t), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot use %T as a time", v)
+}
+
+func formatDate(layout string, v interface{}) (string, error) {
+	t, err := toTime(v)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(layout), nil
+}
+
+func formatDateUTC(layout string, v interface{}) (string, error) {
+	t, err := toTime(v)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(layout), nil
+}
+
+func unixTime(v interface{}) (int64, error) {
+	t, err := toTime(v)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// ago renders the time elapsed since v, rounded to seconds.
+func ago(v interface{}) (string, error) {
+	t, err := toTime(v)
+	if err != nil {
+		return "", err
+	}
+	return time.Since(t).Round(time.Second).String(), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// quote renders s as a JSON string literal, so values can be embedded in
+// JSON templates safely.
+func quote(v interface{}) string {
+	b, _ := json.Marshal(fmt.Sprint(v))
+	return string(b)
+}
+
+// jsonPath walks a dotted path (e.g. "k8sEvent.involvedObject.name" or
+// "items.0.name") through the JSON form of v. Missing keys yield nil.
+func jsonPath(path string, v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var cur interface{}
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		if key == "" {
+			continue
+		}
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			cur = c[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, nil
+			}
+			cur = c[i]
+		default:
+			return nil, nil
+		}
+	}
+	return cur, nil
+}
+
+// trunc shortens s to at most n runes; a negative n keeps the last -n runes.
+func trunc(n int, s string) string {
+	r := []rune(s)
+	if n >= 0 && len(r) > n {
+		return string(r[:n])
+	}
+	if n < 0 && len(r) > -n {
+		return string(r[len(r)+n:])
+	}
+	return s
+}
+
+func replace(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+func contains(substr, s string) bool {
+	return strings.Contains(s, substr)
+}
+
+func hasPrefix(prefix, s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+func hasSuffix(suffix, s string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
+func splitList(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+func join(sep string, v interface{}) string {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return fmt.Sprint(v)
+	}
+	parts := make([]string, val.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(val.Index(i).Interface())
+	}
+	return strings.Join(parts, sep)
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+func regexMatch(re, s string) (bool, error) {
+	return regexp.MatchString(re, s)
+}
+
+func regexFind(re, s string) (string, error) {
+	r, err := regexp.Compile(re)
+	if err != nil {
+		return "", err
+	}
+	return r.FindString(s), nil
+}
+
+func regexReplaceAll(re, s, repl string) (string, error) {
+	r, err := regexp.Compile(re)
+	if err != nil {
+		return "", err
+	}
+	return r.ReplaceAllString(s, repl), nil
+}
+
+// empty reports whether v is nil or the zero value of its type.
+func empty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return val.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return val.IsNil()
+	}
+	return reflect.DeepEqual(v, reflect.Zero(val.Type()).Interface())
+}
+
+func defaultValue(def interface{}, v ...interface{}) interface{} {
+	if len(v) == 0 || empty(v[0]) {
+		return def
+	}
+	return v[0]
+}
+
+func coalesce(v ...interface{}) interface{} {
+	for _, x := range v {
+		if !empty(x) {
+			return x
+		}
+	}
+	return nil
+}
+
+func ternary(yes, no interface{}, cond bool) interface{} {
+	if cond {
+		return yes
+	}
+	return no
+}
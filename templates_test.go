@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestToTime(t *testing.T) {
+	ref := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var nilTime *time.Time
+	var nilMeta *metav1.Time
+	var nilMicro *metav1.MicroTime
+	meta := metav1.NewTime(ref)
+	micro := metav1.NewMicroTime(ref)
+	tests := []struct {
+		in      interface{}
+		want    time.Time
+		wantErr bool
+	}{
+		{in: ref, want: ref},
+		{in: &ref, want: ref},
+		{in: nilTime},
+		{in: meta, want: ref},
+		{in: &meta, want: ref},
+		{in: nilMeta},
+		{in: micro, want: ref},
+		{in: &micro, want: ref},
+		{in: nilMicro},
+		{in: "2020-01-02T03:04:05Z", want: ref},
+		{in: "2020-01-02T04:04:05+01:00", want: ref},
+		{in: int(ref.Unix()), want: ref},
+		{in: ref.Unix(), want: ref},
+		{in: float64(ref.Unix()) + 0.9, want: ref},
+		{in: "yesterday", wantErr: true},
+		{in: true, wantErr: true},
+		{in: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := toTime(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("toTime(%#v) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("toTime(%#v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"k8sEvent": v1.Event{
+			InvolvedObject: v1.ObjectReference{Kind: "Pod", Name: "web-0"},
+		},
+		"items": []map[string]string{{"name": "a"}, {"name": "b"}},
+		"count": 3,
+	}
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"k8sEvent.involvedObject.name", "web-0"},
+		{".k8sEvent.involvedObject.kind", "Pod"},
+		{"items.0.name", "a"},
+		{"items.1.name", "b"},
+		{"items.2.name", nil},
+		{"items.-1.name", nil},
+		{"items.first", nil},
+		{"count", float64(3)},
+		{"count.value", nil},
+		{"missing.key", nil},
+	}
+	for _, tt := range tests {
+		got, err := jsonPath(tt.path, doc)
+		if err != nil {
+			t.Errorf("jsonPath(%q) error: %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("jsonPath(%q) = %#v, want %#v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTrunc(t *testing.T) {
+	tests := []struct {
+		n    int
+		s    string
+		want string
+	}{
+		{3, "abcdef", "abc"},
+		{10, "abc", "abc"},
+		{0, "abc", ""},
+		{-2, "abcdef", "ef"},
+		{-10, "abc", "abc"},
+		{2, "héllo", "hé"},
+		{-3, "héllo", "llo"},
+	}
+	for _, tt := range tests {
+		if got := trunc(tt.n, tt.s); got != tt.want {
+			t.Errorf("trunc(%d, %q) = %q, want %q", tt.n, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyDefaultCoalesce(t *testing.T) {
+	var nilPtr *v1.Event
+	zeros := []interface{}{nil, 0, 0.0, "", false, []string{}, map[string]int{}, nilPtr, metav1.Time{}, v1.ObjectReference{}}
+	values := []interface{}{1, -1, "x", true, []string{""}, map[string]int{"a": 0}, &v1.Event{}, metav1.NewTime(time.Unix(1, 0)), v1.ObjectReference{Kind: "Pod"}}
+	for _, z := range zeros {
+		if !empty(z) {
+			t.Errorf("empty(%#v) = false, want true", z)
+		}
+		if got := defaultValue("def", z); got != "def" {
+			t.Errorf("default(\"def\", %#v) = %#v, want def", z, got)
+		}
+	}
+	for _, v := range values {
+		if empty(v) {
+			t.Errorf("empty(%#v) = true, want false", v)
+		}
+		if got := defaultValue("def", v); !reflect.DeepEqual(got, v) {
+			t.Errorf("default(\"def\", %#v) = %#v, want the value", v, got)
+		}
+	}
+	if got := defaultValue("def"); got != "def" {
+		t.Errorf("default without a value = %#v, want def", got)
+	}
+	if got := coalesce(nil, "", 0, "first", "second"); got != "first" {
+		t.Errorf("coalesce = %#v, want first", got)
+	}
+	if got := coalesce(nil, "", false); got != nil {
+		t.Errorf("coalesce of zero values = %#v, want nil", got)
+	}
+}
+
+func TestPayloadTemplateFuncs(t *testing.T) {
+	tmpl, err := parsePayloadTemplate("test", `{{ splitList "," .list | join "|" }} `+
+		`{{ .reason | default "Unknown" | upper }} `+
+		`{{ dateUTC "2006-01-02" .last }} `+
+		`{{ ternary "warn" "info" (eq .type "Warning") }} `+
+		`{{ regexReplaceAll "-[0-9]+$" .name "" }} `+
+		`{{ quote .message }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, map[string]interface{}{
+		"list":    "a,b,c",
+		"last":    metav1.NewTime(time.Date(2020, 1, 2, 23, 0, 0, 0, time.FixedZone("X", -3600))),
+		"type":    "Warning",
+		"name":    "web-12",
+		"message": `say "hi"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `a|b|c UNKNOWN 2020-01-03 warn web "say \"hi\""`
+	if out.String() != want {
+		t.Errorf("rendered %q, want %q", out.String(), want)
+	}
+}
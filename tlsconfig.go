@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader holds the client certificate and CA bundle used to talk to
+// the receiver over mutual TLS. The files are polled and reloaded when
+// they change, so rotated certificates are picked up without a restart.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("--client-cert and --client-key must be set together")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	var files []string
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (r *certReloader) reload() error {
+	modTimes := map[string]time.Time{}
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("load client certificate: %v", err)
+		}
+		cert = &c
+	}
+	var roots *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.roots, r.modTimes = cert, roots, modTimes
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch polls the certificate files and reloads them on change. A failed
+// reload (e.g. a half-written rotation) keeps the previous material.
+func (r *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			log.Printf("reload TLS material error: %v", err)
+			continue
+		}
+		log.Println("reloaded TLS client certificate / CA bundle")
+	}
+}
+
+// tlsConfig returns the client TLS config for connections to serverHost,
+// the host name or IP address of the receiver URL.
+func (r *certReloader) tlsConfig(serverHost string) *tls.Config {
+	config := &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			if r.cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return r.cert, nil
+		},
+	}
+	if r.caFile != "" {
+		// RootCAs is fixed once a connection is configured, so verify
+		// against the current pool ourselves to honour CA rotation.
+		// cs.ServerName is empty for IP addresses, so the host is taken
+		// from the receiver URL; x509 matches IP SANs through DNSName too.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			r.mu.RLock()
+			roots := r.roots
+			r.mu.RUnlock()
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("receiver presented no certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				DNSName:       serverHost,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return config
+}
+
+// newDeliveryClient returns the HTTP client used for deliveries, configured
+// for mutual TLS when a client certificate or CA bundle is given. Only
+// serverURL is verified, as every delivery goes to it.
+func newDeliveryClient(serverURL, certFile, keyFile, caFile string, reloadInterval time.Duration) (*http.Client, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return http.DefaultClient, nil
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in DomeOS server URL %q", serverURL)
+	}
+	r, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	go r.watch(reloadInterval)
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     r.tlsConfig(u.Hostname()),
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}, nil
+}